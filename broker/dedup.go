@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultDedupSize 去重缓存默认最多保存的键数量
+const DefaultDedupSize = 10000
+
+// DedupKeyFunc 从消息中提取去重使用的键，返回空字符串表示不参与去重
+type DedupKeyFunc func(msg *Message) string
+
+type dedupKey struct{}
+
+type dedupValue struct {
+	keyFunc DedupKeyFunc
+	window  time.Duration
+	size    int
+}
+
+// WithDedup 在window时间内跳过键相同的重复消息，重复消息不交给处理函数但仍然会被提交。
+// 只有处理成功的消息才会被记录，处理失败后重新投递的消息不会被当作重复消息。
+func WithDedup(keyFunc DedupKeyFunc, window time.Duration) SubscribeOption {
+	return SubscribeContextWithValue(dedupKey{}, &dedupValue{keyFunc: keyFunc, window: window, size: DefaultDedupSize})
+}
+
+// NewDedupFromContext 根据WithDedup的设置创建去重器，没有设置时返回nil
+func NewDedupFromContext(ctx context.Context) *Dedup {
+	if ctx == nil {
+		return nil
+	}
+	value, ok := ctx.Value(dedupKey{}).(*dedupValue)
+	if !ok || value == nil || value.keyFunc == nil || value.window <= 0 {
+		return nil
+	}
+	return NewDedup(value.keyFunc, value.window, value.size)
+}
+
+// Dedup 带TTL的LRU去重器，最多保存size个键
+type Dedup struct {
+	sync.Mutex
+
+	keyFunc DedupKeyFunc
+	window  time.Duration
+	size    int
+
+	ll    *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+}
+
+type dedupEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+func NewDedup(keyFunc DedupKeyFunc, window time.Duration, size int) *Dedup {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	return &Dedup{
+		keyFunc: keyFunc,
+		window:  window,
+		size:    size,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Seen 消息在窗口期内已经出现过时返回true，否则记录该消息并返回false。
+// 处理可能失败时应当分别调用Contains和Record，处理成功之后再记录，以免失败后重新投递的消息被当作重复消息跳过。
+func (d *Dedup) Seen(msg *Message) bool {
+	key := d.keyFunc(msg)
+	if key == "" {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.contains(key) {
+		return true
+	}
+	d.record(key)
+	return false
+}
+
+// Contains 消息在窗口期内已经出现过时返回true，不记录该消息
+func (d *Dedup) Contains(msg *Message) bool {
+	key := d.keyFunc(msg)
+	if key == "" {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	return d.contains(key)
+}
+
+// Record 记录消息，窗口期从现在开始计算
+func (d *Dedup) Record(msg *Message) {
+	key := d.keyFunc(msg)
+	if key == "" {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.record(key)
+}
+
+func (d *Dedup) contains(key string) bool {
+	el, ok := d.items[key]
+	if !ok {
+		return false
+	}
+	if !d.now().Before(el.Value.(*dedupEntry).expireAt) {
+		return false
+	}
+	d.ll.MoveToFront(el)
+	return true
+}
+
+func (d *Dedup) record(key string) {
+	expireAt := d.now().Add(d.window)
+
+	if el, ok := d.items[key]; ok {
+		el.Value.(*dedupEntry).expireAt = expireAt
+		d.ll.MoveToFront(el)
+		return
+	}
+
+	d.items[key] = d.ll.PushFront(&dedupEntry{key: key, expireAt: expireAt})
+
+	for d.ll.Len() > d.size {
+		d.removeElement(d.ll.Back())
+	}
+}
+
+// Len 当前缓存的键数量
+func (d *Dedup) Len() int {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.ll.Len()
+}
+
+func (d *Dedup) removeElement(el *list.Element) {
+	d.ll.Remove(el)
+	delete(d.items, el.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+	now := time.Now()
+	d := NewDedup(func(msg *Message) string {
+		return msg.Headers["id"]
+	}, time.Minute, 2)
+	d.now = func() time.Time { return now }
+
+	msg := func(id string) *Message {
+		return &Message{Headers: map[string]string{"id": id}}
+	}
+
+	assert.False(t, d.Seen(msg("1")))
+	assert.True(t, d.Seen(msg("1")))
+	assert.False(t, d.Seen(msg("")))
+	assert.False(t, d.Seen(msg("")))
+
+	// 超过窗口期后不再视为重复
+	now = now.Add(time.Minute)
+	assert.False(t, d.Seen(msg("1")))
+
+	// 超过容量时淘汰最久未使用的键
+	assert.False(t, d.Seen(msg("2")))
+	assert.False(t, d.Seen(msg("3")))
+	assert.Equal(t, 2, d.Len())
+	assert.False(t, d.Seen(msg("1")))
+
+	// 只检查不记录
+	assert.False(t, d.Contains(msg("4")))
+	assert.False(t, d.Contains(msg("4")))
+	d.Record(msg("4"))
+	assert.True(t, d.Contains(msg("4")))
+}
@@ -7,7 +7,8 @@ import (
 
 	"github.com/go-kratos/kratos/v2/encoding"
 	_ "github.com/go-kratos/kratos/v2/encoding/json"
-	_ "github.com/go-kratos/kratos/v2/encoding/proto"
+	protoCodec "github.com/go-kratos/kratos/v2/encoding/proto"
+	"google.golang.org/protobuf/proto"
 )
 
 func Marshal(codec encoding.Codec, msg Any) ([]byte, error) {
@@ -16,6 +17,12 @@ func Marshal(codec encoding.Codec, msg Any) ([]byte, error) {
 	}
 
 	if codec != nil {
+		if codec.Name() == protoCodec.Name {
+			if _, ok := msg.(proto.Message); !ok {
+				return nil, errors.New("message is not a proto message")
+			}
+		}
+
 		dataBuffer, err := codec.Marshal(msg)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,23 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/encoding"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtoCodec(t *testing.T) {
+	codec := encoding.GetCodec("proto")
+
+	buf, err := Marshal(codec, wrapperspb.String("hello"))
+	assert.Nil(t, err)
+
+	var body Any = &wrapperspb.StringValue{}
+	assert.Nil(t, Unmarshal(codec, buf, &body))
+	assert.Equal(t, "hello", body.(*wrapperspb.StringValue).GetValue())
+
+	_, err = Marshal(codec, map[string]string{"hello": "world"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,29 @@
+package broker
+
+// PublishFunc 发送消息的函数，签名与Broker.Publish相同
+type PublishFunc func(topic string, msg Any, opts ...PublishOption) error
+
+// ProducerInterceptor 包装发送过程，不调用next即可丢弃消息
+type ProducerInterceptor func(next PublishFunc) PublishFunc
+
+// ConsumerInterceptor 包装消息处理函数，不调用next并返回nil即可丢弃消息
+type ConsumerInterceptor func(next Handler) Handler
+
+// ChainProducerInterceptors 按注册顺序包装publish，先注册的拦截器在最外层
+func ChainProducerInterceptors(publish PublishFunc, interceptors ...ProducerInterceptor) PublishFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		publish = interceptors[i](publish)
+	}
+	return publish
+}
+
+// ChainConsumerInterceptors 按注册顺序包装handler，先注册的拦截器在最外层
+func ChainConsumerInterceptors(handler Handler, interceptors ...ConsumerInterceptor) Handler {
+	if handler == nil {
+		return nil
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = interceptors[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,106 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+)
+
+// CreateTopic 创建主题，configs为主题级别的配置，例如retention.ms和cleanup.policy。
+// 主题已存在时返回的错误可以用errors.Is(err, kafkaGo.TopicAlreadyExists)判断
+func (b *kafkaBroker) CreateTopic(ctx context.Context, name string, partitions, replication int, configs map[string]string) error {
+	entries := make([]kafkaGo.ConfigEntry, 0, len(configs))
+	for k, v := range configs {
+		entries = append(entries, kafkaGo.ConfigEntry{ConfigName: k, ConfigValue: v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ConfigName < entries[j].ConfigName
+	})
+
+	res, err := b.newClient().CreateTopics(ctx, &kafkaGo.CreateTopicsRequest{
+		Topics: []kafkaGo.TopicConfig{{
+			Topic:             name,
+			NumPartitions:     partitions,
+			ReplicationFactor: replication,
+			ConfigEntries:     entries,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return res.Errors[name]
+}
+
+// DeleteTopic 删除主题，主题不存在时返回的错误可以用errors.Is(err, kafkaGo.UnknownTopicOrPartition)判断
+func (b *kafkaBroker) DeleteTopic(ctx context.Context, name string) error {
+	res, err := b.newClient().DeleteTopics(ctx, &kafkaGo.DeleteTopicsRequest{
+		Topics: []string{name},
+	})
+	if err != nil {
+		return err
+	}
+	return res.Errors[name]
+}
+
+// TopicExists 通过元数据请求判断主题是否存在，不会触发自动创建主题
+func (b *kafkaBroker) TopicExists(ctx context.Context, name string) (bool, error) {
+	meta, err := b.newClient().Metadata(ctx, &kafkaGo.MetadataRequest{Topics: []string{name}})
+	if err != nil {
+		return false, err
+	}
+
+	for _, topic := range meta.Topics {
+		if topic.Name != name {
+			continue
+		}
+		if errors.Is(topic.Error, kafkaGo.UnknownTopicOrPartition) {
+			return false, nil
+		}
+		if topic.Error != nil {
+			return false, topic.Error
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// OffsetSpec ResetOffsets重置到的位置
+type OffsetSpec struct {
+	latest bool
+	time   time.Time
+}
+
+var (
+	// OffsetEarliest 分区中最早的消息
+	OffsetEarliest = OffsetSpec{time: time.UnixMilli(0)}
+	// OffsetLatest 分区的末尾，只消费之后发送的消息
+	OffsetLatest = OffsetSpec{latest: true}
+)
+
+// OffsetAtTime 时间t之后的第一条消息，t之后没有消息的分区重置到末尾
+func OffsetAtTime(t time.Time) OffsetSpec {
+	return OffsetSpec{time: t}
+}
+
+// ResetOffsets 重置消费组在主题各分区已提交的位点，用于故障恢复时跳过或者重新消费消息。
+// 有活跃成员的消费组提交位点会被Kafka拒绝，所以需要先停止所有消费者，否则返回ErrGroupActive
+func (b *kafkaBroker) ResetOffsets(ctx context.Context, topic, group string, to OffsetSpec) error {
+	res, err := b.newClient().DescribeGroups(ctx, &kafkaGo.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return err
+	}
+	for _, g := range res.Groups {
+		if g.Error != nil {
+			return g.Error
+		}
+		if len(g.Members) > 0 {
+			return fmt.Errorf("%w: %s has %d members", ErrGroupActive, group, len(g.Members))
+		}
+	}
+
+	return b.commitGroupOffsets(ctx, group, []string{topic}, to)
+}
@@ -0,0 +1,118 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState 发送熔断器的状态
+type CircuitState int
+
+const (
+	// CircuitClosed 正常发送
+	CircuitClosed CircuitState = iota
+	// CircuitOpen 连续失败次数达到阈值，冷却时间内的发送直接返回ErrCircuitOpen
+	CircuitOpen
+	// CircuitHalfOpen 冷却时间结束，放行一次探测发送，成功后关闭熔断器，失败后重新打开
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker 发送熔断器，未设置WithCircuitBreaker时为nil，所有方法都可以在nil上调用。
+type circuitBreaker struct {
+	sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow 熔断器打开时返回ErrCircuitOpen，冷却时间结束后只放行一次探测
+func (c *circuitBreaker) allow() error {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		if c.now().Sub(c.openedAt) < c.cooldown {
+			return ErrCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		c.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if c.probing {
+			return ErrCircuitOpen
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// record 记录一次发送的结果
+func (c *circuitBreaker) record(err error) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.probing = false
+
+	if err == nil {
+		c.state = CircuitClosed
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= c.threshold {
+		c.state = CircuitOpen
+		c.openedAt = c.now()
+	}
+}
+
+func (c *circuitBreaker) State() CircuitState {
+	if c == nil {
+		return CircuitClosed
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.state == CircuitOpen && c.now().Sub(c.openedAt) >= c.cooldown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kafkaGo "github.com/segmentio/kafka-go"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+const collectorNamespace = "kafka"
+
+var (
+	writerMessagesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "writer", "messages_total"),
+		"Number of messages written by the writer of the topic.",
+		[]string{"topic"}, nil,
+	)
+	writerBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "writer", "bytes_total"),
+		"Number of bytes written by the writer of the topic.",
+		[]string{"topic"}, nil,
+	)
+	writerErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "writer", "errors_total"),
+		"Number of errors of the writer of the topic.",
+		[]string{"topic"}, nil,
+	)
+	writerRetriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "writer", "retries_total"),
+		"Number of retries of the writer of the topic.",
+		[]string{"topic"}, nil,
+	)
+	readerLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "reader", "lag"),
+		"Lag of the subscriptions of the topic and group.",
+		[]string{"topic", "group"}, nil,
+	)
+	inflightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "publish", "inflight"),
+		"Number of asynchronous publishes not yet completed.",
+		nil, nil,
+	)
+	circuitStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(collectorNamespace, "circuit", "state"),
+		"State of the publish circuit breaker: 0 closed, 1 open, 2 half-open.",
+		nil, nil,
+	)
+)
+
+// writerTotals Writer统计信息的累计值
+type writerTotals struct {
+	messages float64
+	bytes    float64
+	errors   float64
+	retries  float64
+}
+
+type collector struct {
+	b *kafkaBroker
+
+	mu     sync.Mutex
+	totals map[string]*writerTotals
+}
+
+// NewCollector 创建Prometheus采集器，采集Writer的发送统计、订阅的消费延迟、异步发送中的消息数和熔断器状态。
+// b不是Kafka的Broker时不采集任何指标。
+//
+// 注意：kafka-go的Writer.Stats()返回的是上次调用之后的增量，采集器累计每次采集到的增量，
+// 所以同时使用WriterStats或WithWriterStatsHandler时，被它们取走的部分不会计入采集器的计数。
+func NewCollector(b broker.Broker) prometheus.Collector {
+	kb, _ := b.(*kafkaBroker)
+	return &collector{
+		b:      kb,
+		totals: make(map[string]*writerTotals),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- writerMessagesDesc
+	ch <- writerBytesDesc
+	ch <- writerErrorsDesc
+	ch <- writerRetriesDesc
+	ch <- readerLagDesc
+	ch <- inflightDesc
+	ch <- circuitStateDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	if c.b == nil {
+		return
+	}
+
+	c.collectWriters(ch)
+	c.collectReaders(ch)
+
+	ch <- prometheus.MustNewConstMetric(inflightDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&c.b.inflight)))
+	ch <- prometheus.MustNewConstMetric(circuitStateDesc, prometheus.GaugeValue, float64(c.b.CircuitState()))
+}
+
+func (c *collector) collectWriters(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.b.RLock()
+	if c.b.writer != nil {
+		c.b.writer.Range(func(topic string, writer *kafkaGo.Writer) {
+			stats := writer.Stats()
+
+			totals, ok := c.totals[topic]
+			if !ok {
+				totals = &writerTotals{}
+				c.totals[topic] = totals
+			}
+			totals.messages += float64(stats.Messages)
+			totals.bytes += float64(stats.Bytes)
+			totals.errors += float64(stats.Errors)
+			totals.retries += float64(stats.Retries)
+		})
+	}
+	c.b.RUnlock()
+
+	// Writer被关闭后仍然保留累计值，计数器不能回退
+	for topic, totals := range c.totals {
+		ch <- prometheus.MustNewConstMetric(writerMessagesDesc, prometheus.CounterValue, totals.messages, topic)
+		ch <- prometheus.MustNewConstMetric(writerBytesDesc, prometheus.CounterValue, totals.bytes, topic)
+		ch <- prometheus.MustNewConstMetric(writerErrorsDesc, prometheus.CounterValue, totals.errors, topic)
+		ch <- prometheus.MustNewConstMetric(writerRetriesDesc, prometheus.CounterValue, totals.retries, topic)
+	}
+}
+
+func (c *collector) collectReaders(ch chan<- prometheus.Metric) {
+	type key struct {
+		topic string
+		group string
+	}
+
+	// 同一主题和消费组可能有多个订阅，合并为一个指标
+	lags := make(map[key]int64)
+	c.b.subscribersMu.Lock()
+	for sub := range c.b.subscribers {
+		lags[key{topic: sub.topic, group: sub.opts.Queue}] += sub.Lag()
+	}
+	c.b.subscribersMu.Unlock()
+
+	for k, lag := range lags {
+		ch <- prometheus.MustNewConstMetric(readerLagDesc, prometheus.GaugeValue, float64(lag), k.topic, k.group)
+	}
+}
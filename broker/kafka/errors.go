@@ -0,0 +1,79 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNoBrokers 没有设置Kafka的地址，或者所有地址都无法连接
+	ErrNoBrokers = errors.New("kafka: no available brokers")
+
+	// ErrNotConnected Disconnect之后发送消息
+	ErrNotConnected = errors.New("kafka: not connected")
+
+	// ErrNoTopics 订阅时没有指定主题
+	ErrNoTopics = errors.New("kafka: no topics to subscribe")
+
+	// ErrNilHandler 订阅时处理函数为nil
+	ErrNilHandler = errors.New("kafka: handler is nil")
+
+	// ErrPublishTimeout 发送消息超时
+	ErrPublishTimeout = errors.New("kafka: publish timeout")
+
+	// ErrPartitionConflict 同时指定了分区和按键哈希的均衡器
+	ErrPartitionConflict = errors.New("kafka: explicit partition conflicts with key-based balancer")
+
+	// ErrInvalidPartition 指定的分区小于0
+	ErrInvalidPartition = errors.New("kafka: invalid partition")
+
+	// ErrMessageTooLarge 消息体超过了WithMaxMessageBytes的限制
+	ErrMessageTooLarge = errors.New("kafka: message too large")
+
+	// ErrHeaderNotFound 消息中没有指定的消息头
+	ErrHeaderNotFound = errors.New("kafka: header not found")
+
+	// ErrHandlerTimeout 处理函数超过WithHandlerTimeout设置的时间没有返回
+	ErrHandlerTimeout = errors.New("kafka: handler timeout")
+
+	// ErrCircuitOpen 连续发送失败触发了WithCircuitBreaker设置的熔断，冷却时间内不再发送
+	ErrCircuitOpen = errors.New("kafka: circuit breaker is open")
+
+	// ErrCodecMismatch PublishMulti的主题通过WithTopicCodec设置了不同的编解码器
+	ErrCodecMismatch = errors.New("kafka: topics use different codecs")
+
+	// ErrGroupActive 消费组还有活跃的成员，不能重置位点
+	ErrGroupActive = errors.New("kafka: consumer group is active")
+
+	// ErrMessageDropped 消息被发送拦截器丢弃，没有写入Kafka
+	ErrMessageDropped = errors.New("kafka: message dropped by interceptor")
+
+	// ErrInvalidTLSConfig TLS版本和加密套件的组合无效
+	ErrInvalidTLSConfig = errors.New("kafka: invalid tls config")
+)
+
+// BatchError 批量发送消息时的部分失败信息，键为消息在批次中的下标。
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "kafka: %d messages failed in batch:", len(e.Errors))
+	for _, i := range e.Indices() {
+		_, _ = fmt.Fprintf(&sb, " [%d] %s;", i, e.Errors[i].Error())
+	}
+	return sb.String()
+}
+
+// Indices 返回发送失败的消息下标，升序排列。
+func (e *BatchError) Indices() []int {
+	indices := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
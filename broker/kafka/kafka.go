@@ -1,20 +1,25 @@
 package kafka
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	semConv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"go.opentelemetry.io/otel/trace"
 
+	"github.com/go-kratos/kratos/v2/encoding"
 	"github.com/go-kratos/kratos/v2/log"
 
 	kafkaGo "github.com/segmentio/kafka-go"
@@ -26,6 +31,29 @@ import (
 
 const (
 	defaultAddr = "127.0.0.1:9092"
+
+	defaultStatsInterval   = time.Minute
+	defaultGracefulTimeout = 30 * time.Second
+	defaultHealthStaleness = 5 * time.Minute
+	defaultResolveInterval = time.Minute
+	defaultCommitInterval  = time.Second
+
+	defaultBatchMaxRecords = 100
+	defaultBatchMaxWait    = time.Second
+	flushPollInterval      = 5 * time.Millisecond
+
+	// reconnectThreshold 开启自动重连时，连续失败多少次之后重建Reader或Writer
+	reconnectThreshold = 3
+
+	// maxNackRedeliveries 没有设置死信主题时，被Nack的消息最多重新投递的次数
+	maxNackRedeliveries = 10
+
+	// HeaderDeathCount 死信消息的处理失败次数
+	HeaderDeathCount = "x-death-count"
+	// HeaderOriginalTopic 死信消息原来所在的主题
+	HeaderOriginalTopic = "x-original-topic"
+	// HeaderCorrelationID WithCorrelationIDKey使用的关联ID消息头
+	HeaderCorrelationID = "x-correlation-id"
 )
 
 type kafkaBroker struct {
@@ -38,14 +66,122 @@ type kafkaBroker struct {
 	writer *Writer
 
 	connected    bool
+	disconnected bool
 	opts         broker.Options
 	retriesCount int
 
 	producerTracer *tracing.Tracer
 	consumerTracer *tracing.Tracer
+
+	metrics *metrics
+	breaker *circuitBreaker
+
+	retryBackoff retryBackoff
+
+	keyFunc          KeyFunc
+	correlationIDKey interface{}
+	errorHandler     ErrorHandler
+	propagator       propagation.TextMapPropagator
+	idempotent       bool
+	autoReconnect    bool
+	customBalancer   bool
+	headerCodec      encoding.Codec
+
+	inflight int64
+
+	subscribers   map[*subscriber]struct{}
+	subscribersMu sync.Mutex
+
+	maxMessageBytes      int
+	compressionThreshold int
+
+	logger      *KratosLogger
+	errorLogger *KratosLogger
+
+	writerStats     *writerStatsValue
+	writerStatsStop chan struct{}
+
+	resolver     *resolverValue
+	resolverStop chan struct{}
+}
+
+// Broker 在broker.Broker的基础上扩展了Kafka专有的方法
+type Broker interface {
+	broker.Broker
+
+	// PublishSync 同步发送消息，阻塞直到Kafka确认写入。
+	PublishSync(topic string, msg broker.Any, opts ...broker.PublishOption) error
+
+	// PublishWithResult 同步发送消息，返回消息写入的分区和位点。
+	// 异步发送的结果可以通过WithCompletionHandler获取。
+	PublishWithResult(topic string, msg broker.Any, opts ...broker.PublishOption) (*PublishResult, error)
+
+	// PublishMulti 把同一条消息发送到多个主题，消息只序列化一次
+	PublishMulti(topics []string, msg broker.Any, opts ...broker.PublishOption) error
+
+	// PublishRaw 直接发送已经序列化好的数据，不经过编解码器
+	PublishRaw(topic string, data []byte, opts ...broker.PublishOption) error
+
+	// PublishBatch 批量发送消息，所有消息通过一次WriteMessages写入。
+	PublishBatch(topic string, msgs []broker.Any, opts ...broker.PublishOption) error
+
+	// Ping 连接集群并请求元数据，用于健康检查。
+	Ping(ctx context.Context) error
+
+	// Flush 等待所有异步发送的消息完成写入，不关闭Writer。
+	Flush(ctx context.Context) error
+
+	// Stop 停止所有订阅并等待正在处理的消息完成，然后刷新并关闭Writer。
+	// ctx结束时不再等待，返回ctx.Err()。
+	Stop(ctx context.Context) error
+
+	// SubscribeTopics 使用同一个消费者组订阅多个主题
+	SubscribeTopics(topics []string, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error)
+
+	// SubscribePartition 不使用消费组，从offset开始消费指定的分区
+	SubscribePartition(topic string, partition int, offset int64, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error)
+
+	// ReadRange 不使用消费组读取分区中[startOffset, endOffset)范围内的消息，用于回放和补数据
+	ReadRange(ctx context.Context, topic string, partition int, startOffset, endOffset int64) ([]*broker.Message, error)
+
+	// SubscribeBatch 批量消费消息，批次的大小和等待时间由WithBatchConsume设置
+	SubscribeBatch(topic string, handler BatchHandler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error)
+
+	// ActiveSubscriptions 返回当前活跃的订阅，按开始时间排序
+	ActiveSubscriptions() []SubscriptionInfo
+
+	// ResetOffsets 把消费组在主题各分区已提交的位点重置到最早、最新或者指定时间，消费组必须没有活跃的成员
+	ResetOffsets(ctx context.Context, topic, group string, to OffsetSpec) error
+
+	// CreateTopic 创建主题，可以指定分区数、副本数和主题配置
+	CreateTopic(ctx context.Context, name string, partitions, replication int, configs map[string]string) error
+
+	// DeleteTopic 删除主题
+	DeleteTopic(ctx context.Context, name string) error
+
+	// TopicExists 判断主题是否存在
+	TopicExists(ctx context.Context, name string) (bool, error)
+
+	// CircuitState 返回发送熔断器的状态，未设置WithCircuitBreaker时总是CircuitClosed
+	CircuitState() CircuitState
+
+	// WriterStats 返回主题对应的Writer自上次调用以来的统计信息，Writer不存在时返回零值。
+	WriterStats(topic string) kafkaGo.WriterStats
+}
+
+var _ Broker = (*kafkaBroker)(nil)
+
+// PublishResult 消息写入Kafka后的位置
+type PublishResult struct {
+	Topic     string
+	Partition int
+	Offset    int64
+
+	// Attempts 实际写入的次数，包括第一次写入和重试
+	Attempts int
 }
 
-func NewBroker(opts ...broker.Option) broker.Broker {
+func NewBroker(opts ...broker.Option) Broker {
 	options := broker.NewOptionsAndApply(opts...)
 
 	b := &kafkaBroker{
@@ -64,11 +200,23 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 		},
 		opts:         options,
 		retriesCount: 1,
+		retryBackoff: defaultRetryBackoff,
 	}
 
+	// 在Init之前创建的Writer也使用WithBalancerInstance设置的均衡器
+	b.initBalancer()
+
 	return b
 }
 
+// initBalancer 设置了WithBalancerInstance时使用自定义的均衡器替换默认的LeastBytes
+func (b *kafkaBroker) initBalancer() {
+	if value, ok := b.opts.Context.Value(balancerInstanceKey{}).(kafkaGo.Balancer); ok && value != nil {
+		b.writerConfig.Balancer = value
+		b.customBalancer = true
+	}
+}
+
 func (b *kafkaBroker) Name() string {
 	return "kafka"
 }
@@ -87,6 +235,10 @@ func (b *kafkaBroker) Options() broker.Options {
 func (b *kafkaBroker) Init(opts ...broker.Option) error {
 	b.opts.Apply(opts...)
 
+	if err := b.opts.CheckTopicCodecs(); err != nil {
+		return err
+	}
+
 	var addrs []string
 	for _, addr := range b.opts.Addrs {
 		if len(addr) == 0 {
@@ -105,7 +257,32 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 	if value, ok := b.opts.Context.Value(enableOneTopicOneWriterKey{}).(bool); ok {
 		enableOneTopicOneWriter = value
 	}
+	// 重复调用Init时关闭之前缓存的Writer，之后发送时按新的配置重新创建
+	b.Lock()
+	if b.writer != nil {
+		b.writer.Close()
+	}
 	b.writer = NewWriter(enableOneTopicOneWriter)
+	b.Unlock()
+
+	if value, ok := b.opts.Context.Value(writerStatsKey{}).(*writerStatsValue); ok && value.handler != nil {
+		if value.interval <= 0 {
+			value.interval = defaultStatsInterval
+		}
+		b.writerStats = value
+	}
+
+	b.autoReconnect = false
+	if value, ok := b.opts.Context.Value(autoReconnectKey{}).(bool); ok {
+		b.autoReconnect = value
+	}
+
+	if value, ok := b.opts.Context.Value(resolverKey{}).(*resolverValue); ok && value.resolver != nil {
+		if value.interval <= 0 {
+			value.interval = defaultResolveInterval
+		}
+		b.resolver = value
+	}
 
 	if value, ok := b.opts.Context.Value(writerConfigKey{}).(WriterConfig); ok {
 		b.writerConfig = value
@@ -157,19 +334,18 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 	if value, ok := b.opts.Context.Value(maxAttemptsKey{}).(int); ok {
 		b.readerConfig.MaxAttempts = value
 	}
+	if value, ok := b.opts.Context.Value(saslScramKey{}).(*saslScramValue); ok {
+		mechanism, err := newScramMechanism(value.Algorithm, value.Username, value.Password)
+		if err != nil {
+			return err
+		}
+		b.saslMechanism = mechanism
+	}
 	if value, ok := b.opts.Context.Value(mechanismKey{}).(sasl.Mechanism); ok {
 		b.saslMechanism = value
-
-		if b.readerConfig.Dialer == nil {
-			dialer := &kafkaGo.Dialer{
-				Timeout:       10 * time.Second,
-				DualStack:     true,
-				SASLMechanism: b.saslMechanism,
-			}
-			b.readerConfig.Dialer = dialer
-		} else {
-			b.readerConfig.Dialer.SASLMechanism = b.saslMechanism
-		}
+	}
+	if b.saslMechanism != nil {
+		b.ownDialer().SASLMechanism = b.saslMechanism
 	}
 	if value, ok := b.opts.Context.Value(readerConfigKey{}).(kafkaGo.ReaderConfig); ok {
 		b.readerConfig = value
@@ -182,27 +358,64 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 			b.readerConfig.Dialer.Timeout = value
 		}
 	}
+	if value, ok := b.opts.Context.Value(readCommittedKey{}).(bool); ok && value {
+		b.readerConfig.IsolationLevel = kafkaGo.ReadCommitted
+	}
 
-	if b.opts.Secure && b.opts.TLSConfig != nil {
-		if b.readerConfig.Dialer == nil {
-			dialer := &kafkaGo.Dialer{
-				Timeout:   10 * time.Second,
-				DualStack: true,
-			}
-			b.readerConfig.Dialer = dialer
+	if value, ok := b.opts.Context.Value(tlsFilesKey{}).(*tlsFilesValue); ok {
+		tlsConfig, err := loadTLSConfig(value.CAFile, value.CertFile, value.KeyFile)
+		if err != nil {
+			return fmt.Errorf("kafka: load tls files failed: %w", err)
+		}
+		b.opts.TLSConfig = tlsConfig
+		b.opts.Secure = true
+	}
+
+	minVersion, hasMinVersion := b.opts.Context.Value(tlsMinVersionKey{}).(uint16)
+	cipherSuites, hasCipherSuites := b.opts.Context.Value(tlsCipherSuitesKey{}).([]uint16)
+	if hasMinVersion || hasCipherSuites {
+		// 复制一份，不修改调用方传入的配置
+		tlsConfig := &tls.Config{}
+		if b.opts.TLSConfig != nil {
+			tlsConfig = b.opts.TLSConfig.Clone()
+		}
+		if hasMinVersion {
+			tlsConfig.MinVersion = minVersion
+		}
+		if hasCipherSuites {
+			tlsConfig.CipherSuites = cipherSuites
 		}
-		b.readerConfig.Dialer.TLS = b.opts.TLSConfig
+		if err := validateTLSConfig(tlsConfig); err != nil {
+			return err
+		}
+		b.opts.TLSConfig = tlsConfig
+		b.opts.Secure = true
+	}
+
+	if b.opts.Secure && b.opts.TLSConfig != nil {
+		b.ownDialer().TLS = b.opts.TLSConfig
 	}
 
 	if cnt, ok := b.opts.Context.Value(retriesCountKey{}).(int); ok {
 		b.retriesCount = cnt
 	}
+	if value, ok := b.opts.Context.Value(retryBackoffKey{}).(retryBackoff); ok {
+		b.retryBackoff = value
+	}
 
 	if len(b.opts.Tracings) > 0 {
 		b.producerTracer = tracing.NewTracer(trace.SpanKindProducer, "kafka-producer", b.opts.Tracings...)
 		b.consumerTracer = tracing.NewTracer(trace.SpanKindConsumer, "kafka-consumer", b.opts.Tracings...)
 	}
 
+	if b.opts.MeterProvider != nil {
+		m, err := newMetrics(b.opts.MeterProvider)
+		if err != nil {
+			return err
+		}
+		b.metrics = m
+	}
+
 	if value, ok := b.opts.Context.Value(loggerKey{}).(kafkaGo.Logger); ok {
 		b.readerConfig.Logger = value
 		b.writerConfig.Logger = value
@@ -231,6 +444,15 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 		}
 	}
 
+	if value, ok := b.opts.Context.Value(kratosLoggerKey{}).(log.Logger); ok && value != nil {
+		b.logger = NewKratosLogger(value, log.LevelDebug)
+		b.errorLogger = NewKratosLogger(value, log.LevelError)
+		b.readerConfig.Logger = b.logger
+		b.readerConfig.ErrorLogger = b.errorLogger
+		b.writerConfig.Logger = b.logger
+		b.writerConfig.ErrorLogger = b.errorLogger
+	}
+
 	//if value, ok := b.opts.Context.Value(balancerKey{}).(string); ok {
 	//	switch value {
 	//	default:
@@ -255,6 +477,8 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 	//	}
 	//}
 
+	b.initBalancer()
+
 	if value, ok := b.opts.Context.Value(batchSizeKey{}).(int); ok {
 		b.writerConfig.BatchSize = value
 	}
@@ -267,6 +491,10 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 		b.writerConfig.BatchBytes = value
 	}
 
+	if value, ok := b.opts.Context.Value(maxMessageBytesKey{}).(int); ok {
+		b.maxMessageBytes = value
+	}
+
 	if value, ok := b.opts.Context.Value(asyncKey{}).(bool); ok {
 		b.writerConfig.Async = value
 	}
@@ -275,6 +503,23 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 		b.writerConfig.MaxAttempts = value
 	}
 
+	if value, ok := b.opts.Context.Value(requiredAcksKey{}).(string); ok {
+		acks, err := parseRequiredAcks(value)
+		if err != nil {
+			return err
+		}
+		b.writerConfig.RequiredAcks = acks
+	}
+
+	if value, ok := b.opts.Context.Value(idempotentKey{}).(bool); ok && value {
+		if async, ok := b.opts.Context.Value(asyncKey{}).(bool); ok && async {
+			log.Warn("[kafka]: idempotent producer can not be async, async publish is disabled")
+		}
+		b.idempotent = true
+		b.writerConfig.RequiredAcks = kafkaGo.RequireAll
+		b.writerConfig.Async = false
+	}
+
 	if value, ok := b.opts.Context.Value(readTimeoutKey{}).(time.Duration); ok {
 		b.writerConfig.ReadTimeout = value
 	}
@@ -287,6 +532,58 @@ func (b *kafkaBroker) Init(opts ...broker.Option) error {
 		b.writerConfig.AllowAutoTopicCreation = value
 	}
 
+	if value, ok := b.opts.Context.Value(keyFuncKey{}).(KeyFunc); ok {
+		b.keyFunc = value
+	}
+
+	if value, ok := b.opts.Context.Value(circuitBreakerKey{}).(*circuitBreakerValue); ok && value.failures > 0 {
+		b.breaker = newCircuitBreaker(value.failures, value.cooldown)
+	}
+
+	if value := b.opts.Context.Value(correlationIDKeyKey{}); value != nil {
+		b.correlationIDKey = value
+	}
+
+	if value, ok := b.opts.Context.Value(propagationKey{}).(propagation.TextMapPropagator); ok {
+		b.propagator = value
+	}
+
+	if value, ok := b.opts.Context.Value(errorHandlerKey{}).(ErrorHandler); ok {
+		b.errorHandler = value
+	}
+
+	if value, ok := b.opts.Context.Value(completionKey{}).(func(messages []kafkaGo.Message, err error)); ok {
+		b.writerConfig.Completion = value
+	}
+
+	if value, ok := b.opts.Context.Value(compressionKey{}).(string); ok {
+		compression, err := parseCompression(value)
+		if err != nil {
+			return err
+		}
+		b.writerConfig.Compression = compression
+	}
+
+	if value, ok := b.opts.Context.Value(headerCodecKey{}).(string); ok {
+		b.headerCodec = encoding.GetCodec(value)
+		if b.headerCodec == nil {
+			return fmt.Errorf("kafka: unknown header codec: %s", value)
+		}
+	}
+
+	// 最后调用，可以覆盖前面所有的配置
+	if value, ok := b.opts.Context.Value(writerConfigFuncKey{}).(func(*WriterConfig)); ok && value != nil {
+		value(&b.writerConfig)
+	}
+
+	if value, ok := b.opts.Context.Value(compressionThresholdKey{}).(int); ok {
+		b.compressionThreshold = value
+	}
+	if b.compressionThreshold > 0 && b.writerConfig.Compression != 0 {
+		b.writer.Uncompressed = NewWriter(enableOneTopicOneWriter)
+		b.writer.Uncompressed.noCompression = true
+	}
+
 	return nil
 }
 
@@ -303,14 +600,31 @@ func (b *kafkaBroker) Connect() error {
 		kAddrs = append(kAddrs, addr)
 	}
 
+	if b.resolver != nil {
+		var err error
+		if kAddrs, err = b.resolve(b.opts.Context); err != nil {
+			return err
+		}
+	}
+
 	if len(kAddrs) == 0 {
-		return errors.New("no available commons")
+		return ErrNoBrokers
 	}
 
 	b.Lock()
 	b.opts.Addrs = kAddrs
 	b.readerConfig.Brokers = kAddrs
+	b.writerConfig.Brokers = kAddrs
 	b.connected = true
+	b.disconnected = false
+	if b.writerStats != nil {
+		b.writerStatsStop = make(chan struct{})
+		go b.runWriterStats(b.writerStatsStop)
+	}
+	if b.resolver != nil {
+		b.resolverStop = make(chan struct{})
+		go b.runResolver(b.resolverStop)
+	}
 	b.Unlock()
 
 	return nil
@@ -328,12 +642,198 @@ func (b *kafkaBroker) Disconnect() error {
 	defer b.Unlock()
 	b.writer.Close()
 
+	if b.writerStatsStop != nil {
+		close(b.writerStatsStop)
+		b.writerStatsStop = nil
+	}
+	if b.resolverStop != nil {
+		close(b.resolverStop)
+		b.resolverStop = nil
+	}
+
 	b.connected = false
+	b.disconnected = true
 	return nil
 }
 
+func (b *kafkaBroker) WriterStats(topic string) kafkaGo.WriterStats {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.writer == nil {
+		return kafkaGo.WriterStats{}
+	}
+	writer, ok := b.writer.get(topic)
+	if !ok || writer == nil {
+		return kafkaGo.WriterStats{}
+	}
+	return writer.Stats()
+}
+
+func (b *kafkaBroker) runWriterStats(stop chan struct{}) {
+	ticker := time.NewTicker(b.writerStats.interval)
+	defer ticker.Stop()
+
+	type topicStats struct {
+		topic string
+		stats kafkaGo.WriterStats
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var all []topicStats
+			b.RLock()
+			b.writer.Range(func(topic string, writer *kafkaGo.Writer) {
+				all = append(all, topicStats{topic: topic, stats: writer.Stats()})
+			})
+			b.RUnlock()
+
+			for _, v := range all {
+				b.writerStats.handler(v.topic, v.stats)
+			}
+		}
+	}
+}
+
+// resolve 调用WithResolver设置的函数解析Kafka的地址，忽略空地址
+func (b *kafkaBroker) resolve(ctx context.Context) ([]string, error) {
+	resolved, err := b.resolver.resolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(resolved))
+	for _, addr := range resolved {
+		if len(addr) > 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoBrokers
+	}
+	return addrs, nil
+}
+
+func (b *kafkaBroker) runResolver(stop chan struct{}) {
+	ticker := time.NewTicker(b.resolver.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			addrs, err := b.resolve(b.opts.Context)
+			if err != nil {
+				log.Errorf("[kafka]: resolve brokers failed: %v", err)
+				continue
+			}
+
+			b.Lock()
+			b.opts.Addrs = addrs
+			b.readerConfig.Brokers = addrs
+			b.writerConfig.Brokers = addrs
+			b.Unlock()
+		}
+	}
+}
+
+func (b *kafkaBroker) Stop(ctx context.Context) error {
+	b.subscribersMu.Lock()
+	subs := make([]*subscriber, 0, len(b.subscribers))
+	for sub := range b.subscribers {
+		subs = append(subs, sub)
+	}
+	b.subscribersMu.Unlock()
+
+	for _, sub := range subs {
+		sub.stop()
+	}
+
+	var err error
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, sub := range subs {
+		if e := sub.closeReader(); e != nil {
+			log.Errorf("[kafka]: close reader failed: %v", e)
+		}
+	}
+
+	if err == nil {
+		err = b.Flush(ctx)
+	}
+
+	if e := b.Disconnect(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// ownDialer 返回Reader专属的Dialer，避免修改全局的kafkaGo.DefaultDialer
+func (b *kafkaBroker) ownDialer() *kafkaGo.Dialer {
+	if b.readerConfig.Dialer == nil || b.readerConfig.Dialer == kafkaGo.DefaultDialer {
+		b.readerConfig.Dialer = &kafkaGo.Dialer{
+			Timeout:   10 * time.Second,
+			DualStack: true,
+		}
+	}
+	return b.readerConfig.Dialer
+}
+
+func (b *kafkaBroker) Ping(ctx context.Context) error {
+	dialer := b.readerConfig.Dialer
+	if dialer == nil {
+		dialer = kafkaGo.DefaultDialer
+	}
+
+	var err error
+	for _, addr := range b.opts.Addrs {
+		var conn *kafkaGo.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", addr); err != nil {
+			continue
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		_, err = conn.Brokers()
+		_ = conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = ErrNoBrokers
+	}
+
+	return err
+}
+
 func (b *kafkaBroker) initPublishOption(writer *kafkaGo.Writer, options broker.PublishOptions) {
+	// 通过WithPartition指定了分区的消息绕过均衡器
+	defer func() {
+		writer.Balancer = newPartitionBalancer(writer.Balancer)
+	}()
+
 	//writer.Balancer = b.writerConfig.Balancer
+	if b.customBalancer {
+		// 自定义的均衡器优先于预置的均衡器
+		return
+	}
 	if value, ok := options.Context.Value(balancerKey{}).(*balancerValue); ok {
 		switch value.Name {
 		default:
@@ -368,276 +868,1641 @@ func (b *kafkaBroker) initPublishOption(writer *kafkaGo.Writer, options broker.P
 }
 
 func (b *kafkaBroker) Publish(topic string, msg broker.Any, opts ...broker.PublishOption) error {
-	buf, err := broker.Marshal(b.opts.Codec, msg)
+	return b.intercept(b.publishMessage)(topic, msg, opts...)
+}
+
+// intercept 使用WithProducerInterceptor设置的拦截器包装publish，所有发送方式都经过拦截器
+func (b *kafkaBroker) intercept(publish broker.PublishFunc) broker.PublishFunc {
+	return broker.ChainProducerInterceptors(publish, b.opts.ProducerInterceptors...)
+}
+
+func (b *kafkaBroker) publishMessage(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+	buf, opts, err := b.encodeMessage(topic, msg, opts)
 	if err != nil {
 		return err
 	}
 
-	if b.writer.EnableOneTopicOneWriter {
-		return b.publishMultipleWriter(topic, buf, opts...)
-	} else {
-		return b.publishOneWriter(topic, buf, opts...)
-	}
+	return b.publish(topic, buf, opts...)
 }
 
-func (b *kafkaBroker) publishMultipleWriter(topic string, buf []byte, opts ...broker.PublishOption) error {
-	options := broker.PublishOptions{
-		Context: context.Background(),
-	}
-	for _, o := range opts {
-		o(&options)
+// PublishRaw 直接发送已经序列化好的数据，不经过编解码器，也不调用WithKeyFunc设置的函数。
+// 拦截器收到的消息体是[]byte，替换消息体时也必须是[]byte。
+func (b *kafkaBroker) PublishRaw(topic string, data []byte, opts ...broker.PublishOption) error {
+	return b.intercept(b.publishRaw)(topic, data, opts...)
+}
+
+func (b *kafkaBroker) publishRaw(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+	data, ok := msg.([]byte)
+	if !ok {
+		return fmt.Errorf("kafka: raw message must be []byte, got %T", msg)
 	}
 
-	kMsg := kafkaGo.Message{
-		Topic: topic,
-		Value: buf,
+	if err := b.checkMessageSize(data); err != nil {
+		return err
 	}
 
-	if headers, ok := options.Context.Value(messageHeadersKey{}).(map[string]interface{}); ok {
-		for k, v := range headers {
-			header := kafkaGo.Header{Key: k}
-			switch t := v.(type) {
-			case string:
-				header.Value = []byte(t)
-			case []byte:
-				header.Value = t
-			default:
-				var buf bytes.Buffer
-				enc := gob.NewEncoder(&buf)
-				if err := enc.Encode(v); err != nil {
-					continue
-				}
-				header.Value = buf.Bytes()
-			}
-			kMsg.Headers = append(kMsg.Headers, header)
-		}
+	return b.publish(topic, data, opts...)
+}
+
+func (b *kafkaBroker) PublishSync(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+	return b.Publish(topic, msg, append(opts, WithSyncPublish())...)
+}
+
+// PublishWithResult 拦截器丢弃消息时返回ErrMessageDropped
+func (b *kafkaBroker) PublishWithResult(topic string, msg broker.Any, opts ...broker.PublishOption) (*PublishResult, error) {
+	var result *PublishResult
+	err := b.intercept(func(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+		var err error
+		result, err = b.publishWithResult(topic, msg, opts...)
+		return err
+	})(topic, msg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrMessageDropped
 	}
+	return result, nil
+}
 
-	if value, ok := options.Context.Value(messageKeyKey{}).([]byte); ok {
-		kMsg.Key = value
+func (b *kafkaBroker) publishWithResult(topic string, msg broker.Any, opts ...broker.PublishOption) (*PublishResult, error) {
+	if err := b.checkConnected(); err != nil {
+		return nil, err
 	}
 
-	if value, ok := options.Context.Value(messageOffsetKey{}).(int64); ok {
-		kMsg.Offset = value
+	buf, opts, err := b.encodeMessage(topic, msg, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	var cached bool
-	b.Lock()
-	writer, ok := b.writer.Writers[topic]
-	if !ok {
-		writer = b.writer.CreateProducer(b.writerConfig, b.saslMechanism, b.opts.TLSConfig)
-		b.initPublishOption(writer, options)
-		b.writer.Writers[topic] = writer
-	} else {
-		cached = true
+	options := broker.NewPublishOptions(opts...)
+
+	if err := checkPartition(options); err != nil {
+		return nil, err
 	}
-	b.Unlock()
 
-	var err error
+	cancel := withPublishTimeout(&options)
+	defer cancel()
 
-	span := b.startProducerSpan(options.Context, &kMsg)
-	defer b.finishProducerSpan(span, int32(kMsg.Partition), kMsg.Offset, err)
+	return b.publishSync(topic, buf, options)
+}
 
-	err = writer.WriteMessages(options.Context, kMsg)
+// encodeMessage 提取消息键并使用主题的编解码器序列化消息体
+func (b *kafkaBroker) encodeMessage(topic string, msg broker.Any, opts []broker.PublishOption) ([]byte, []broker.PublishOption, error) {
+	opts, err := b.withMessageKey(msg, opts)
 	if err != nil {
-		log.Errorf("WriteMessages error: %s", err.Error())
-		switch cached {
-		case false:
-			var kerr kafkaGo.Error
-			if errors.As(err, &kerr) {
-				if kerr.Temporary() && !kerr.Timeout() {
-					time.Sleep(200 * time.Millisecond)
-					err = writer.WriteMessages(options.Context, kMsg)
-				}
-			}
-		case true:
-			b.Lock()
-			if err = writer.Close(); err != nil {
-				b.Unlock()
-				break
-			}
-			delete(b.writer.Writers, topic)
-			b.Unlock()
+		return nil, nil, err
+	}
 
-			writer = b.writer.CreateProducer(b.writerConfig, b.saslMechanism, b.opts.TLSConfig)
-			b.initPublishOption(writer, options)
-			for i := 0; i < b.retriesCount; i++ {
-				if err = writer.WriteMessages(options.Context, kMsg); err == nil {
-					b.Lock()
-					b.writer.Writers[topic] = writer
-					b.Unlock()
-					break
-				}
-			}
-		}
+	buf, err := b.marshalMessage(topic, msg)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return err
+	return buf, opts, nil
 }
 
-func (b *kafkaBroker) publishOneWriter(topic string, buf []byte, opts ...broker.PublishOption) error {
-	options := broker.PublishOptions{
-		Context: context.Background(),
+// withMessageKey 设置了WithKeyFunc时提取消息键，调用方显式指定的消息键优先
+func (b *kafkaBroker) withMessageKey(msg broker.Any, opts []broker.PublishOption) ([]broker.PublishOption, error) {
+	if b.keyFunc == nil {
+		return opts, nil
 	}
-	for _, o := range opts {
+
+	key, err := b.keyFunc(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]broker.PublishOption{WithMessageKey(key)}, opts...), nil
+}
+
+// marshalMessage 使用主题的编解码器序列化消息体并检查大小
+func (b *kafkaBroker) marshalMessage(topic string, msg broker.Any) ([]byte, error) {
+	buf, err := broker.Marshal(b.opts.CodecFor(topic), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.checkMessageSize(buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (b *kafkaBroker) publish(topic string, buf []byte, opts ...broker.PublishOption) error {
+	if err := b.checkConnected(); err != nil {
+		return err
+	}
+
+	options := broker.NewPublishOptions(opts...)
+
+	if err := checkPartition(options); err != nil {
+		return err
+	}
+
+	cancel := withPublishTimeout(&options)
+	defer cancel()
+
+	if value, ok := options.Context.Value(syncPublishKey{}).(bool); ok && value {
+		_, err := b.publishSync(topic, buf, options)
+		return err
+	}
+
+	return b.publishCached(topic, buf, options)
+}
+
+// checkConnected Disconnect之后发送消息返回ErrNotConnected，Connect之前可以直接发送
+func (b *kafkaBroker) checkConnected() error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.disconnected {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// checkMessageSize 消息体超过WithMaxMessageBytes的限制时返回ErrMessageTooLarge
+func (b *kafkaBroker) checkMessageSize(buf []byte) error {
+	if b.maxMessageBytes > 0 && len(buf) > b.maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrMessageTooLarge, len(buf), b.maxMessageBytes)
+	}
+	return nil
+}
+
+// withPublishTimeout 如果设置了发送超时，则为发送上下文加上超时时间。
+func withPublishTimeout(options *broker.PublishOptions) context.CancelFunc {
+	if value, ok := options.Context.Value(publishTimeoutKey{}).(time.Duration); ok && value > 0 {
+		var cancel context.CancelFunc
+		options.Context, cancel = context.WithTimeout(options.Context, value)
+		return cancel
+	}
+	return func() {}
+}
+
+// wrapPublishError 将超时错误包装为ErrPublishTimeout，以便和broker拒绝写入的错误区分开。
+func wrapPublishError(err error) error {
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrPublishTimeout, err.Error())
+	}
+	return err
+}
+
+// publishSync 使用一个独立的同步Writer发送消息，等待Kafka按照RequiredAcks的要求确认后才返回。
+func (b *kafkaBroker) publishSync(topic string, buf []byte, options broker.PublishOptions) (*PublishResult, error) {
+	if err := b.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	kMsg := b.newKafkaMessage(topic, buf, options)
+
+	writer := b.createSyncProducer(len(buf), options)
+
+	var partition int
+	var offset int64
+	completion := writer.Completion
+	writer.Completion = func(messages []kafkaGo.Message, err error) {
+		if completion != nil {
+			completion(messages, err)
+		}
+		if err != nil || len(messages) == 0 {
+			return
+		}
+		partition = messages[0].Partition
+		offset = messages[0].Offset
+	}
+
+	var err error
+	start := time.Now()
+
+	span := b.startProducerSpan(options.Context, &kMsg)
+	defer func() {
+		b.finishProducerSpan(span, int32(partition), offset, err)
+		b.metrics.recordPublish(options.Context, topic, partition, 1, start, err)
+	}()
+
+	err = b.writeMessages(options.Context, writer, kMsg)
+	if err != nil && isTemporaryError(err) {
+		for i := 0; i < b.retriesCount; i++ {
+			if waitContext(options.Context, b.retryBackoff.duration(i)) != nil {
+				break
+			}
+			b.metrics.recordRetry(options.Context, topic)
+			if err = b.writeMessages(options.Context, writer, kMsg); err == nil || !isTemporaryError(err) {
+				break
+			}
+		}
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	b.breaker.record(err)
+	if err != nil {
+		log.Errorf("WriteMessages error: %s", err.Error())
+	}
+
+	if err = wrapPublishError(err); err != nil {
+		return nil, err
+	}
+
+	return &PublishResult{Topic: topic, Partition: partition, Offset: offset, Attempts: MessageAttempts(kMsg)}, nil
+}
+
+// createSyncProducer 创建一个同步发送的Writer，使用完毕后需要调用方关闭。size为要发送的消息体的大小
+func (b *kafkaBroker) createSyncProducer(size int, options broker.PublishOptions) *kafkaGo.Writer {
+	writerConfig := b.writerConfig
+	writerConfig.Async = false
+
+	writer := b.writerCache(size).CreateProducer(writerConfig, b.saslMechanism, b.opts.TLSConfig)
+	b.initPublishOption(writer, options)
+
+	return writer
+}
+
+// newKafkaMessage 根据发布选项构建kafka-go消息
+func (b *kafkaBroker) newKafkaMessage(topic string, buf []byte, options broker.PublishOptions) kafkaGo.Message {
+	data := &writerData{partition: -1}
+	kMsg := kafkaGo.Message{
+		Topic:      topic,
+		Value:      buf,
+		WriterData: data,
+	}
+
+	if headers, ok := options.Context.Value(messageHeadersKey{}).(map[string]interface{}); ok {
+		kMsg.Headers = append(kMsg.Headers, mapToKafkaHeader(b.headerCodec, headers)...)
+	}
+
+	if id := b.correlationID(options.Context); id != "" && !hasHeader(kMsg.Headers, HeaderCorrelationID) {
+		kMsg.Headers = append(kMsg.Headers, kafkaGo.Header{Key: HeaderCorrelationID, Value: []byte(id)})
+	}
+
+	if value, ok := options.Context.Value(messageKeyKey{}).([]byte); ok {
+		kMsg.Key = value
+	}
+
+	if value, ok := options.Context.Value(messageOffsetKey{}).(int64); ok {
+		kMsg.Offset = value
+	}
+
+	if value, ok := options.Context.Value(messageTimeKey{}).(time.Time); ok {
+		kMsg.Time = value
+	}
+
+	if value, ok := options.Context.Value(messagePartitionKey{}).(int); ok {
+		kMsg.Partition = value
+		data.partition = value
+	}
+
+	return kMsg
+}
+
+// correlationID 从上下文中读取WithCorrelationIDKey指定的关联ID
+func (b *kafkaBroker) correlationID(ctx context.Context) string {
+	if b.correlationIDKey == nil || ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(b.correlationIDKey).(string)
+	return id
+}
+
+// withCorrelationID 把消息头中的关联ID放回处理函数的上下文
+func (b *kafkaBroker) withCorrelationID(ctx context.Context, headers []kafkaGo.Header) context.Context {
+	if b.correlationIDKey == nil {
+		return ctx
+	}
+	for _, h := range headers {
+		if h.Key == HeaderCorrelationID && len(h.Value) > 0 {
+			return context.WithValue(ctx, b.correlationIDKey, string(h.Value))
+		}
+	}
+	return ctx
+}
+
+// checkPartition 校验WithPartition指定的分区
+func checkPartition(options broker.PublishOptions) error {
+	partition, ok := options.Context.Value(messagePartitionKey{}).(int)
+	if !ok {
+		return nil
+	}
+	if partition < 0 {
+		return ErrInvalidPartition
+	}
+	if value, ok := options.Context.Value(balancerKey{}).(*balancerValue); ok {
+		switch value.Name {
+		case HashBalancer, ReferenceHashBalancer, Crc32Balancer, Murmur2Balancer:
+			return ErrPartitionConflict
+		}
+	}
+	return nil
+}
+
+// publishCached 使用缓存的Writer发送消息，发送失败时重建Writer并重试。
+func (b *kafkaBroker) publishCached(topic string, buf []byte, options broker.PublishOptions) error {
+	if err := b.breaker.allow(); err != nil {
+		return err
+	}
+
+	kMsg := b.newKafkaMessage(topic, buf, options)
+
+	var cached bool
+	b.Lock()
+	cache := b.writerCache(len(buf))
+	writer, ok := cache.get(topic)
+	if !ok {
+		writer = b.createCachedProducer(cache, options)
+		if b.logger != nil && cache.EnableOneTopicOneWriter {
+			writer.Logger = b.logger.With("topic", topic)
+			writer.ErrorLogger = b.errorLogger.With("topic", topic)
+		}
+		cache.set(topic, writer)
+	} else {
+		cached = true
+	}
+	b.Unlock()
+
+	var err error
+	start := time.Now()
+
+	span := b.startProducerSpan(options.Context, &kMsg)
+	defer func() {
+		b.finishProducerSpan(span, int32(kMsg.Partition), kMsg.Offset, err)
+		b.metrics.recordPublish(options.Context, topic, -1, 1, start, err)
+		// 异步发送成功只表示消息进入了队列，投递结果在完成回调中记录
+		if err != nil || !writer.Async {
+			b.breaker.record(err)
+		}
+	}()
+
+	err = b.writeMessages(options.Context, writer, kMsg)
+	if err != nil {
+		log.Errorf("WriteMessages error: %s", err.Error())
+
+		// 幂等发送时，超时无法确定消息是否已经写入，重发可能导致消息重复
+		if b.idempotent && isAmbiguousError(err) {
+			return wrapPublishError(err)
+		}
+
+		retry := true
+		if cached {
+			// 缓存的Writer可能已经失效，关闭之后重新创建
+			b.Lock()
+			if cerr := writer.Close(); cerr != nil {
+				b.Unlock()
+				return wrapPublishError(cerr)
+			}
+			cache.remove(topic)
+			b.Unlock()
+
+			writer = b.createCachedProducer(cache, options)
+		} else {
+			retry = isTemporaryError(err)
+		}
+
+		if retry {
+			for i := 0; i < b.retriesCount; i++ {
+				if err = waitContext(options.Context, b.retryBackoff.duration(i)); err != nil {
+					break
+				}
+				b.metrics.recordRetry(options.Context, topic)
+				if err = b.writeMessages(options.Context, writer, kMsg); err == nil {
+					if cached {
+						b.Lock()
+						cache.set(topic, writer)
+						b.Unlock()
+					}
+					break
+				}
+			}
+		}
+
+		if err != nil && cached {
+			_ = writer.Close()
+		}
+	}
+
+	return wrapPublishError(err)
+}
+
+// PublishBatch 每条消息分别经过拦截器，被丢弃的消息不写入，也不算作失败
+func (b *kafkaBroker) PublishBatch(topic string, msgs []broker.Any, opts ...broker.PublishOption) error {
+	if err := b.checkConnected(); err != nil {
+		return err
+	}
+
+	options := broker.NewPublishOptions(opts...)
+
+	if err := checkPartition(options); err != nil {
+		return err
+	}
+
+	cancel := withPublishTimeout(&options)
+	defer cancel()
+
+	keys, _ := options.Context.Value(batchMessageKeysKey{}).([][]byte)
+	headers, _ := options.Context.Value(batchHeadersKey{}).([]map[string]interface{})
+
+	batchErr := &BatchError{Errors: make(map[int]error)}
+
+	kMsgs := make([]kafkaGo.Message, 0, len(msgs))
+	indices := make([]int, 0, len(msgs))
+	for i, msg := range msgs {
+		// 拦截器之后的消息不直接发送，而是收集起来通过一次WriteMessages写入
+		err := b.intercept(func(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+			buf, opts, err := b.encodeMessage(topic, msg, opts)
+			if err != nil {
+				return err
+			}
+
+			msgOptions := broker.NewPublishOptions(opts...)
+			if err = checkPartition(msgOptions); err != nil {
+				return err
+			}
+
+			kMsg := b.newKafkaMessage(topic, buf, msgOptions)
+			if i < len(keys) && keys[i] != nil {
+				kMsg.Key = keys[i]
+			}
+			if i < len(headers) && headers[i] != nil {
+				kMsg.Headers = append(kMsg.Headers, mapToKafkaHeader(b.headerCodec, headers[i])...)
+			}
+
+			kMsgs = append(kMsgs, kMsg)
+			indices = append(indices, i)
+			return nil
+		})(topic, msg, opts...)
+		if err != nil {
+			batchErr.Errors[i] = err
+		}
+	}
+
+	if len(kMsgs) > 0 {
+		b.writeBatch(topic, kMsgs, indices, options, batchErr)
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// PublishMulti 只序列化一次，把同一条消息发送到多个主题，返回的*BatchError中的下标对应topics中的位置。
+// 多个主题共用一个Writer时通过一次WriteMessages写入，开启一个主题一个Writer时逐个主题发送。
+// 每个主题的消息分别经过拦截器，拦截器替换了消息体时重新序列化。
+func (b *kafkaBroker) PublishMulti(topics []string, msg broker.Any, opts ...broker.PublishOption) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	if err := b.checkConnected(); err != nil {
+		return err
+	}
+
+	// 消息只序列化一次，所有主题必须使用相同的编解码器
+	for _, topic := range topics[1:] {
+		if b.opts.CodecFor(topic) != b.opts.CodecFor(topics[0]) {
+			return ErrCodecMismatch
+		}
+	}
+
+	options := broker.NewPublishOptions(opts...)
+
+	if err := checkPartition(options); err != nil {
+		return err
+	}
+
+	type multiMessage struct {
+		topic string
+		buf   []byte
+		opts  []broker.PublishOption
+		index int
+	}
+
+	// 拦截器原样传递消息体时直接使用这里序列化的结果
+	encoded := msg
+	encodedBuf, err := b.marshalMessage(topics[0], msg)
+	if err != nil {
+		return err
+	}
+
+	batchErr := &BatchError{Errors: make(map[int]error)}
+
+	multi := make([]multiMessage, 0, len(topics))
+	for i, topic := range topics {
+		err := b.intercept(func(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+			opts, err := b.withMessageKey(msg, opts)
+			if err != nil {
+				return err
+			}
+
+			buf := encodedBuf
+			if !sameMessage(encoded, msg) {
+				if buf, err = b.marshalMessage(topic, msg); err != nil {
+					return err
+				}
+			}
+
+			if err = checkPartition(broker.NewPublishOptions(opts...)); err != nil {
+				return err
+			}
+
+			multi = append(multi, multiMessage{topic: topic, buf: buf, opts: opts, index: i})
+			return nil
+		})(topic, msg, opts...)
+		if err != nil {
+			batchErr.Errors[i] = err
+		}
+	}
+
+	syncPublish, _ := options.Context.Value(syncPublishKey{}).(bool)
+	if b.writer.EnableOneTopicOneWriter && !syncPublish {
+		for _, m := range multi {
+			if err := b.publish(m.topic, m.buf, m.opts...); err != nil {
+				batchErr.Errors[m.index] = err
+			}
+		}
+	} else if len(multi) > 0 {
+		cancel := withPublishTimeout(&options)
+		defer cancel()
+
+		kMsgs := make([]kafkaGo.Message, 0, len(multi))
+		indices := make([]int, 0, len(multi))
+		for _, m := range multi {
+			kMsgs = append(kMsgs, b.newKafkaMessage(m.topic, m.buf, broker.NewPublishOptions(m.opts...)))
+			indices = append(indices, m.index)
+		}
+
+		b.writeBatch("", kMsgs, indices, options, batchErr)
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// writeBatch 通过一次WriteMessages写入多条消息，失败的消息按indices记录到batchErr中
+func (b *kafkaBroker) writeBatch(topic string, kMsgs []kafkaGo.Message, indices []int, options broker.PublishOptions, batchErr *BatchError) {
+	if err := b.breaker.allow(); err != nil {
+		for _, i := range indices {
+			batchErr.Errors[i] = err
+		}
+		return
+	}
+
+	// 压缩以批次为单位，按整批消息体的大小选择是否压缩
+	var size int
+	for i := range kMsgs {
+		size += len(kMsgs[i].Value)
+	}
+
+	var writer *kafkaGo.Writer
+	if value, ok := options.Context.Value(syncPublishKey{}).(bool); ok && value {
+		writer = b.createSyncProducer(size, options)
+		defer writer.Close()
+	} else {
+		writer = b.getWriter(topic, size, options)
+	}
+
+	spans := make([]trace.Span, len(kMsgs))
+	counts := make(map[string]int)
+	for i := range kMsgs {
+		spans[i] = b.startProducerSpan(options.Context, &kMsgs[i])
+		counts[kMsgs[i].Topic]++
+	}
+
+	start := time.Now()
+	err := b.writeMessages(options.Context, writer, kMsgs...)
+	if err != nil || !writer.Async {
+		b.breaker.record(err)
+	}
+	for t, n := range counts {
+		b.metrics.recordPublish(options.Context, t, -1, n, start, err)
+	}
+	if err != nil {
+		log.Errorf("WriteMessages error: %s", err.Error())
+
+		var writeErrors kafkaGo.WriteErrors
+		if errors.As(err, &writeErrors) {
+			for i, e := range writeErrors {
+				if e != nil {
+					batchErr.Errors[indices[i]] = e
+				}
+			}
+		} else {
+			err = wrapPublishError(err)
+			for _, i := range indices {
+				batchErr.Errors[i] = err
+			}
+		}
+	}
+
+	for i := range kMsgs {
+		b.finishProducerSpan(spans[i], int32(kMsgs[i].Partition), kMsgs[i].Offset, batchErr.Errors[indices[i]])
+	}
+}
+
+func (b *kafkaBroker) CircuitState() CircuitState {
+	return b.breaker.State()
+}
+
+// getWriter 获取缓存的Writer，如果不存在则创建一个。size为要发送的消息体的大小
+func (b *kafkaBroker) getWriter(topic string, size int, options broker.PublishOptions) *kafkaGo.Writer {
+	b.Lock()
+	defer b.Unlock()
+
+	cache := b.writerCache(size)
+	writer, ok := cache.get(topic)
+	if !ok {
+		writer = b.createCachedProducer(cache, options)
+		cache.set(topic, writer)
+	}
+	return writer
+}
+
+// writerCache 设置了WithCompressionThreshold时，消息体不超过阈值的消息使用不压缩的Writer发送
+func (b *kafkaBroker) writerCache(size int) *Writer {
+	if b.writer.Uncompressed != nil && size <= b.compressionThreshold {
+		return b.writer.Uncompressed
+	}
+	return b.writer
+}
+
+// createCachedProducer 创建缓存在cache中的Writer，异步发送时在完成回调中统计未完成的消息数，供Flush等待。
+func (b *kafkaBroker) createCachedProducer(cache *Writer, options broker.PublishOptions) *kafkaGo.Writer {
+	writer := cache.CreateProducer(b.writerConfig, b.saslMechanism, b.opts.TLSConfig)
+	b.initPublishOption(writer, options)
+
+	if writer.Async {
+		completion := writer.Completion
+		var failures int32
+		writer.Completion = func(messages []kafkaGo.Message, err error) {
+			atomic.AddInt64(&b.inflight, -int64(len(messages)))
+			b.breaker.record(err)
+			if b.autoReconnect {
+				// 异步发送的错误不会进入发送失败的重建流程，连续失败时丢弃该Writer，下次发送时重新创建
+				if err == nil {
+					atomic.StoreInt32(&failures, 0)
+				} else if atomic.AddInt32(&failures, 1) == reconnectThreshold {
+					go b.resetWriter(writer)
+				}
+			}
+			if completion != nil {
+				completion(messages, err)
+			}
+		}
+	}
+
+	return writer
+}
+
+// resetWriter 从缓存中移除并关闭Writer
+func (b *kafkaBroker) resetWriter(writer *kafkaGo.Writer) {
+	var topics []string
+	b.Lock()
+	b.writer.Range(func(topic string, w *kafkaGo.Writer) {
+		if w == writer {
+			topics = append(topics, topic)
+		}
+	})
+	for _, topic := range topics {
+		if w, ok := b.writer.get(topic); ok && w == writer {
+			b.writer.remove(topic)
+		} else if b.writer.Uncompressed != nil {
+			b.writer.Uncompressed.remove(topic)
+		}
+	}
+	b.Unlock()
+
+	if len(topics) == 0 {
+		return
+	}
+
+	for _, topic := range topics {
+		log.Infof("[kafka]: writer of topic [%s] keeps failing, recreate it", topic)
+		b.metrics.recordReconnect(b.opts.Context, topic)
+	}
+
+	_ = writer.Close()
+}
+
+// writeMessages 写入消息，异步发送时记录未完成的消息数
+func (b *kafkaBroker) writeMessages(ctx context.Context, writer *kafkaGo.Writer, msgs ...kafkaGo.Message) error {
+	for _, msg := range msgs {
+		if d, ok := msg.WriterData.(*writerData); ok {
+			atomic.AddInt32(&d.attempts, 1)
+		}
+	}
+
+	if !writer.Async {
+		return writer.WriteMessages(ctx, msgs...)
+	}
+
+	atomic.AddInt64(&b.inflight, int64(len(msgs)))
+	err := writer.WriteMessages(ctx, msgs...)
+	if err != nil {
+		atomic.AddInt64(&b.inflight, -int64(len(msgs)))
+	}
+	return err
+}
+
+func (b *kafkaBroker) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&b.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (b *kafkaBroker) Subscribe(topic string, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	options := broker.SubscribeOptions{
+		Context: context.Background(),
+		AutoAck: true,
+		Queue:   uuid.New().String(),
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	readerConfig := b.readerConfig
+	readerConfig.Topic = topic
+	readerConfig.GroupID = options.Queue
+
+	return b.subscribe(topic, readerConfig, handler, binder, options)
+}
+
+func (b *kafkaBroker) SubscribeTopics(topics []string, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if len(topics) == 0 {
+		return nil, ErrNoTopics
+	}
+
+	options := broker.SubscribeOptions{
+		Context: context.Background(),
+		AutoAck: true,
+		Queue:   uuid.New().String(),
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	readerConfig := b.readerConfig
+	readerConfig.Topic = ""
+	readerConfig.GroupTopics = topics
+	readerConfig.GroupID = options.Queue
+
+	return b.subscribe(strings.Join(topics, ","), readerConfig, handler, binder, options)
+}
+
+// SubscribeBatch 批量消费消息，处理函数成功返回时提交批次中每个分区最大的位点，失败时不提交。
+// 解码失败的消息由ErrorHandler返回false时，该分区只提交到这条消息之前。
+func (b *kafkaBroker) SubscribeBatch(topic string, handler BatchHandler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+
+	opts = append(opts, broker.SubscribeContextWithValue(batchHandlerKey{}, handler))
+
+	return b.Subscribe(topic, nil, binder, opts...)
+}
+
+// SubscribePartition 不使用消费组，直接从offset开始消费指定分区，offset可以是kafkaGo.FirstOffset或者kafkaGo.LastOffset。
+// 没有消费组就无法提交位点，因此会关闭自动确认，通常用于排查问题时查看某个分区的消息。
+func (b *kafkaBroker) SubscribePartition(topic string, partition int, offset int64, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if partition < 0 {
+		return nil, ErrInvalidPartition
+	}
+
+	options := broker.SubscribeOptions{
+		Context: context.Background(),
+	}
+	for _, o := range opts {
 		o(&options)
 	}
+	options.AutoAck = false
+	options.Queue = ""
+	options.Context = context.WithValue(options.Context, partitionOffsetKey{}, offset)
+
+	readerConfig := b.readerConfig
+	readerConfig.Topic = topic
+	readerConfig.GroupID = ""
+	readerConfig.Partition = partition
+
+	return b.subscribe(topic, readerConfig, handler, binder, options)
+}
+
+// ReadRange 不使用消费组读取分区中[startOffset, endOffset)范围内的消息，不提交位点。
+// 读到分区末尾时提前返回，startOffset超过分区末尾时阻塞到ctx结束。
+func (b *kafkaBroker) ReadRange(ctx context.Context, topic string, partition int, startOffset, endOffset int64) ([]*broker.Message, error) {
+	if partition < 0 {
+		return nil, ErrInvalidPartition
+	}
+	if startOffset >= endOffset {
+		return nil, nil
+	}
+
+	readerConfig := b.readerConfig
+	readerConfig.Topic = topic
+	readerConfig.GroupID = ""
+	readerConfig.GroupTopics = nil
+	readerConfig.Partition = partition
+
+	reader := kafkaGo.NewReader(readerConfig)
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Errorf("[kafka]: close range reader failed: %v", err)
+		}
+	}()
+
+	if err := reader.SetOffset(startOffset); err != nil {
+		return nil, err
+	}
+
+	var msgs []*broker.Message
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return msgs, err
+		}
+		if msg.Offset >= endOffset {
+			return msgs, nil
+		}
+
+		m := &broker.Message{
+			Headers: kafkaHeaderToMap(msg.Headers),
+			Body:    msg.Value,
+		}
+		if err = broker.Unmarshal(b.opts.CodecFor(topic), msg.Value, &m.Body); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+
+		if msg.Offset+1 >= endOffset || msg.Offset+1 >= msg.HighWaterMark {
+			return msgs, nil
+		}
+	}
+}
+
+func (b *kafkaBroker) subscribe(topic string, readerConfig kafkaGo.ReaderConfig, handler broker.Handler, binder broker.Binder, options broker.SubscribeOptions) (broker.Subscriber, error) {
+	if b.logger != nil {
+		kvs := []interface{}{"topic", topic}
+		if readerConfig.GroupID == "" {
+			kvs = append(kvs, "partition", readerConfig.Partition)
+		}
+		readerConfig.Logger = b.logger.With(kvs...)
+		readerConfig.ErrorLogger = b.errorLogger.With(kvs...)
+	}
+
+	if value, ok := options.Context.Value(subscribeStartOffsetKey{}).(int64); ok {
+		readerConfig.StartOffset = value
+	}
+
+	if value, ok := b.opts.Context.Value(readerConfigFuncKey{}).(func(*kafkaGo.ReaderConfig)); ok && value != nil {
+		value(&readerConfig)
+	}
+
+	if handler, ok := options.Context.Value(rebalanceHandlerKey{}).(RebalanceHandler); ok && handler != nil && readerConfig.GroupID != "" {
+		readerConfig.Logger = &rebalanceLogger{next: readerConfig.Logger, handler: handler}
+	}
+
+	startTime, hasStartTime := options.Context.Value(startTimeKey{}).(time.Time)
+	if hasStartTime && readerConfig.GroupID != "" {
+		onlyUncommitted, _ := options.Context.Value(startTimeIfUncommittedKey{}).(bool)
+		if err := b.seekGroupToTime(options.Context, readerConfig, startTime, onlyUncommitted); err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := b.newReader(readerConfig, options, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(options.Context)
+
+	sub := &subscriber{
+		k:            b,
+		ctx:          ctx,
+		opts:         options,
+		topic:        topic,
+		handler:      broker.ChainConsumerInterceptors(handler, b.opts.ConsumerInterceptors...),
+		binder:       binder,
+		reader:       reader,
+		readerConfig: readerConfig,
+		next:         -1,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		startedAt:    time.Now(),
+
+		gracefulTimeout: defaultGracefulTimeout,
+		healthStaleness: defaultHealthStaleness,
+	}
+
+	if value, ok := options.Context.Value(gracefulTimeoutKey{}).(time.Duration); ok {
+		sub.gracefulTimeout = value
+	}
+	if value, ok := options.Context.Value(handlerTimeoutKey{}).(time.Duration); ok {
+		sub.handlerTimeout = value
+	}
+	if value, ok := options.Context.Value(commitRetriesKey{}).(int); ok {
+		sub.commitRetries = value
+	}
+	if value, ok := options.Context.Value(healthStalenessKey{}).(time.Duration); ok {
+		sub.healthStaleness = value
+	}
+	if value, ok := options.Context.Value(deadLetterKey{}).(*deadLetterValue); ok {
+		sub.deadLetter = value
+	}
+	sub.dedup = broker.NewDedupFromContext(options.Context)
+
+	if handler, ok := options.Context.Value(statsHandlerKey{}).(StatsHandler); ok && handler != nil {
+		interval := readerConfig.ReadLagInterval
+		if value, ok := options.Context.Value(statsIntervalKey{}).(time.Duration); ok {
+			interval = value
+		}
+		if interval <= 0 {
+			interval = defaultStatsInterval
+		}
+		go sub.runStats(ctx, interval, handler)
+	}
+
+	if value, ok := options.Context.Value(startPausedKey{}).(bool); ok && value {
+		sub.Pause()
+	}
+
+	b.addSubscriber(sub)
+
+	go func() {
+		defer close(sub.done)
+		defer b.removeSubscriber(sub)
+		defer func() {
+			if err := sub.closeReader(); err != nil {
+				log.Errorf("[kafka]: close reader failed: %v", err)
+			}
+		}()
+
+		if batchHandler, ok := options.Context.Value(batchHandlerKey{}).(BatchHandler); ok {
+			b.consumeBatch(ctx, sub, batchHandler)
+			return
+		}
+
+		dispatch := func(msg kafkaGo.Message) {
+			b.processMessage(sub, msg)
+		}
+
+		if concurrency, ok := options.Context.Value(concurrencyKey{}).(int); ok && concurrency > 1 {
+			// 同一分区的消息总是交给同一个协程，保证分区内按顺序处理和提交
+			workers := make([]chan kafkaGo.Message, concurrency)
+			var wg sync.WaitGroup
+			for i := range workers {
+				workers[i] = make(chan kafkaGo.Message)
+				wg.Add(1)
+				go func(ch chan kafkaGo.Message) {
+					defer wg.Done()
+					for msg := range ch {
+						b.processMessage(sub, msg)
+					}
+				}(workers[i])
+			}
+			defer func() {
+				for _, ch := range workers {
+					close(ch)
+				}
+				wg.Wait()
+			}()
+
+			dispatch = func(msg kafkaGo.Message) {
+				select {
+				case workers[partitionWorker(msg, concurrency)] <- msg:
+				case <-ctx.Done():
+				}
+			}
+		}
+
+		var failures int
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if !sub.waitResume(ctx) {
+					return
+				}
 
-	kMsg := kafkaGo.Message{
-		Topic: topic,
-		Value: buf,
-	}
+				msg, err := sub.getReader().FetchMessage(ctx)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Errorf("FetchMessage error: %s", err.Error())
+					sub.recordFetch(err)
 
-	if headers, ok := options.Context.Value(messageHeadersKey{}).(map[string]interface{}); ok {
-		for k, v := range headers {
-			header := kafkaGo.Header{Key: k}
-			switch t := v.(type) {
-			case string:
-				header.Value = []byte(t)
-			case []byte:
-				header.Value = t
-			default:
-				var buf bytes.Buffer
-				enc := gob.NewEncoder(&buf)
-				if err := enc.Encode(v); err != nil {
+					if b.autoReconnect {
+						failures++
+						if failures >= reconnectThreshold && !b.reconnectReader(ctx, sub, failures-reconnectThreshold) {
+							return
+						}
+					}
 					continue
 				}
-				header.Value = buf.Bytes()
+				failures = 0
+				sub.recordFetch(nil)
+
+				if readerConfig.GroupID == "" {
+					sub.next = msg.Offset + 1
+				}
+				sub.updateLag(msg)
+
+				dispatch(msg)
 			}
-			kMsg.Headers = append(kMsg.Headers, header)
 		}
+	}()
+
+	return sub, nil
+}
+
+// newReader 创建Reader，不使用消费组时设置起始位点，next不小于0时从next继续消费
+func (b *kafkaBroker) newReader(readerConfig kafkaGo.ReaderConfig, options broker.SubscribeOptions, next int64) (*kafkaGo.Reader, error) {
+	reader := kafkaGo.NewReader(readerConfig)
+
+	if readerConfig.GroupID != "" {
+		return reader, nil
 	}
 
-	if value, ok := options.Context.Value(messageKeyKey{}).([]byte); ok {
-		kMsg.Key = value
+	var err error
+	if next >= 0 {
+		err = reader.SetOffset(next)
+	} else if startTime, ok := options.Context.Value(startTimeKey{}).(time.Time); ok {
+		err = reader.SetOffsetAt(options.Context, startTime)
+	} else if offset, ok := options.Context.Value(partitionOffsetKey{}).(int64); ok {
+		err = reader.SetOffset(offset)
+	}
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
 	}
 
-	if value, ok := options.Context.Value(messageOffsetKey{}).(int64); ok {
-		kMsg.Offset = value
+	return reader, nil
+}
+
+// reconnectReader 按重试退避策略等待之后重建订阅的Reader，订阅已关闭时返回false
+func (b *kafkaBroker) reconnectReader(ctx context.Context, sub *subscriber, attempt int) bool {
+	if err := waitContext(ctx, b.retryBackoff.duration(attempt)); err != nil {
+		return false
 	}
 
-	var cached bool
-	b.Lock()
-	if b.writer.Writer == nil {
-		b.writer.Writer = b.writer.CreateProducer(b.writerConfig, b.saslMechanism, b.opts.TLSConfig)
-		b.initPublishOption(b.writer.Writer, options)
-	} else {
-		cached = true
+	reader, err := b.newReader(sub.readerConfig, sub.opts, sub.next)
+	if err != nil {
+		log.Errorf("[kafka]: reconnect reader of topic [%s] failed: %v", sub.topic, err)
+		return true
 	}
-	b.Unlock()
 
-	var err error
+	if !sub.replaceReader(reader) {
+		return false
+	}
 
-	span := b.startProducerSpan(options.Context, &kMsg)
-	defer b.finishProducerSpan(span, int32(kMsg.Partition), kMsg.Offset, err)
+	log.Infof("[kafka]: reader of topic [%s] reconnected", sub.topic)
+	b.metrics.recordReconnect(ctx, sub.topic)
+
+	return true
+}
+
+func (b *kafkaBroker) addSubscriber(sub *subscriber) {
+	b.subscribersMu.Lock()
+	defer b.subscribersMu.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[*subscriber]struct{})
+	}
+	b.subscribers[sub] = struct{}{}
+}
+
+func (b *kafkaBroker) removeSubscriber(sub *subscriber) {
+	b.subscribersMu.Lock()
+	defer b.subscribersMu.Unlock()
+
+	delete(b.subscribers, sub)
+}
+
+func (b *kafkaBroker) ActiveSubscriptions() []SubscriptionInfo {
+	b.subscribersMu.Lock()
+	infos := make([]SubscriptionInfo, 0, len(b.subscribers))
+	for sub := range b.subscribers {
+		infos = append(infos, sub.info())
+	}
+	b.subscribersMu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
+// newClient 创建用于管理请求的客户端
+func (b *kafkaBroker) newClient() *kafkaGo.Client {
+	return &kafkaGo.Client{
+		Addr: kafkaGo.TCP(b.opts.Addrs...),
+		Transport: &kafkaGo.Transport{
+			SASL: b.saslMechanism,
+			TLS:  b.opts.TLSConfig,
+		},
+	}
+}
+
+// seekGroupToTime 将消费组在各分区已提交的位点重置到时间t之后的第一条消息。
+// 订阅总是使用消费组，而Reader.SetOffsetAt在消费组模式下不可用，所以直接提交位点。
+// onlyUncommitted为true时，已经提交过位点的消费组从已提交的位点继续消费。
+func (b *kafkaBroker) seekGroupToTime(ctx context.Context, readerConfig kafkaGo.ReaderConfig, t time.Time, onlyUncommitted bool) error {
+	topics := readerConfig.GroupTopics
+	if len(topics) == 0 {
+		topics = []string{readerConfig.Topic}
+	}
+
+	if onlyUncommitted {
+		committed, err := b.hasCommittedOffsets(ctx, readerConfig.GroupID, topics)
+		if err != nil {
+			return err
+		}
+		if committed {
+			log.Infof("[kafka]: group [%s] already has committed offsets, start time is ignored", readerConfig.GroupID)
+			return nil
+		}
+	}
+
+	return b.commitGroupOffsets(ctx, readerConfig.GroupID, topics, OffsetAtTime(t))
+}
+
+// hasCommittedOffsets 消费组在主题的任意一个分区上提交过位点时返回true
+func (b *kafkaBroker) hasCommittedOffsets(ctx context.Context, group string, topics []string) (bool, error) {
+	client := b.newClient()
 
-	err = b.writer.Writer.WriteMessages(options.Context, kMsg)
+	meta, err := client.Metadata(ctx, &kafkaGo.MetadataRequest{Topics: topics})
 	if err != nil {
-		log.Errorf("WriteMessages error: %s", err.Error())
-		switch cached {
-		case false:
-			var kerr kafkaGo.Error
-			if errors.As(err, &kerr) {
-				if kerr.Temporary() && !kerr.Timeout() {
-					time.Sleep(200 * time.Millisecond)
-					err = b.writer.Writer.WriteMessages(options.Context, kMsg)
+		return false, err
+	}
+
+	req := &kafkaGo.OffsetFetchRequest{GroupID: group, Topics: map[string][]int{}}
+	for _, topic := range meta.Topics {
+		if topic.Error != nil {
+			return false, topic.Error
+		}
+		for _, partition := range topic.Partitions {
+			req.Topics[topic.Name] = append(req.Topics[topic.Name], partition.ID)
+		}
+	}
+
+	res, err := client.OffsetFetch(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	if res.Error != nil {
+		return false, res.Error
+	}
+	for _, partitions := range res.Topics {
+		for _, partition := range partitions {
+			if partition.Error != nil {
+				return false, partition.Error
+			}
+			// 没有提交过位点的分区返回-1
+			if partition.CommittedOffset >= 0 {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// commitGroupOffsets 查询各分区在to对应的位点并提交为消费组的位点，时间之后没有消息的分区使用最新的位点
+func (b *kafkaBroker) commitGroupOffsets(ctx context.Context, group string, topics []string, to OffsetSpec) error {
+	client := b.newClient()
+
+	meta, err := client.Metadata(ctx, &kafkaGo.MetadataRequest{Topics: topics})
+	if err != nil {
+		return err
+	}
+
+	atTime := &kafkaGo.ListOffsetsRequest{Topics: map[string][]kafkaGo.OffsetRequest{}}
+	latest := &kafkaGo.ListOffsetsRequest{Topics: map[string][]kafkaGo.OffsetRequest{}}
+	for _, topic := range meta.Topics {
+		if topic.Error != nil {
+			return topic.Error
+		}
+		for _, partition := range topic.Partitions {
+			if to.latest {
+				latest.Topics[topic.Name] = append(latest.Topics[topic.Name], kafkaGo.LastOffsetOf(partition.ID))
+				continue
+			}
+			atTime.Topics[topic.Name] = append(atTime.Topics[topic.Name],
+				kafkaGo.OffsetRequest{Partition: partition.ID, Timestamp: to.time.UnixMilli()})
+		}
+	}
+
+	commits := map[string][]kafkaGo.OffsetCommit{}
+
+	if len(atTime.Topics) > 0 {
+		res, err := client.ListOffsets(ctx, atTime)
+		if err != nil {
+			return err
+		}
+		for topic, partitions := range res.Topics {
+			for _, partition := range partitions {
+				if partition.Error != nil {
+					return partition.Error
+				}
+				offset := int64(-1)
+				for o := range partition.Offsets {
+					offset = o
 				}
+				if offset < 0 {
+					// t之后没有消息，从最新的位置开始消费
+					latest.Topics[topic] = append(latest.Topics[topic], kafkaGo.LastOffsetOf(partition.Partition))
+					continue
+				}
+				commits[topic] = append(commits[topic], kafkaGo.OffsetCommit{Partition: partition.Partition, Offset: offset})
 			}
-		case true:
-			b.Lock()
-			if err = b.writer.Writer.Close(); err != nil {
-				b.Unlock()
-				break
+		}
+	}
+
+	if len(latest.Topics) > 0 {
+		res, err := client.ListOffsets(ctx, latest)
+		if err != nil {
+			return err
+		}
+		for topic, partitions := range res.Topics {
+			for _, partition := range partitions {
+				if partition.Error != nil {
+					return partition.Error
+				}
+				commits[topic] = append(commits[topic], kafkaGo.OffsetCommit{Partition: partition.Partition, Offset: partition.LastOffset})
 			}
-			b.writer = nil
-			b.Unlock()
+		}
+	}
 
-			writer := b.writer.CreateProducer(b.writerConfig, b.saslMechanism, b.opts.TLSConfig)
-			b.initPublishOption(writer, options)
-			for i := 0; i < b.retriesCount; i++ {
-				if err = writer.WriteMessages(options.Context, kMsg); err == nil {
-					b.Lock()
-					b.writer.Writer = writer
-					b.Unlock()
-					break
+	commitRes, err := client.OffsetCommit(ctx, &kafkaGo.OffsetCommitRequest{
+		GroupID:      group,
+		GenerationID: -1,
+		Topics:       commits,
+	})
+	if err != nil {
+		return err
+	}
+	for _, partitions := range commitRes.Topics {
+		for _, partition := range partitions {
+			if partition.Error != nil {
+				return partition.Error
+			}
+		}
+	}
+
+	return nil
+}
+
+// processMessage 解码消息并调用订阅者的处理函数
+func (b *kafkaBroker) processMessage(sub *subscriber, msg kafkaGo.Message) {
+	ctx, span := b.startConsumerSpan(sub.opts.Context, &msg)
+	ctx = b.withCorrelationID(ctx, msg.Headers)
+
+	b.metrics.recordConsume(ctx, msg.Topic, msg.Partition)
+
+	m := &broker.Message{
+		Headers: kafkaHeaderToMap(msg.Headers),
+		Body:    nil,
+	}
+
+	p := &publication{
+		topic:         msg.Topic,
+		reader:        sub.getReader(),
+		m:             m,
+		km:            msg,
+		ctx:           sub.opts.Context,
+		headerCodec:   b.headerCodec,
+		commitRetries: sub.commitRetries,
+		commitBackoff: b.retryBackoff,
+	}
+
+	p.typedKey = b.unmarshalKey(sub, msg)
+
+	if err := b.unmarshalBody(sub, msg, m); err != nil {
+		p.err = err
+		log.Errorf("[kafka]: unmarshal message failed: %v", err)
+
+		// 设置了错误处理函数时由它决定是否提交，否则沿用旧的行为：照常交给订阅者处理并提交
+		if b.errorHandler != nil {
+			if b.errorHandler(ctx, m, err) && sub.opts.AutoAck {
+				if err := p.Ack(); err != nil {
+					log.Errorf("[kafka]: unable to commit msg: %v", err)
 				}
 			}
+			b.finishConsumerSpan(span)
+			return
 		}
 	}
 
-	return err
+	// 窗口期内的重复消息不交给处理函数，直接提交
+	if sub.dedup != nil && sub.dedup.Contains(m) {
+		if sub.opts.AutoAck {
+			if err := p.Ack(); err != nil {
+				log.Errorf("[kafka]: unable to commit msg: %v", err)
+			}
+		}
+		b.finishConsumerSpan(span)
+		return
+	}
+
+	var err error
+	var attempts int
+	commit := true
+	for {
+		attempts++
+		if err = sub.handle(ctx, p); err != nil {
+			log.Errorf("[kafka]: process message failed: %v", err)
+		}
+
+		// 超时的处理函数可能还在运行，不再重试
+		if errors.Is(err, ErrHandlerTimeout) {
+			break
+		}
+
+		failed := err != nil || p.nacked
+		if !failed {
+			break
+		}
+
+		if sub.deadLetter != nil {
+			if attempts >= sub.deadLetter.MaxRetries {
+				// 写入死信主题失败时一直重试，不能继续处理该分区之后的消息，否则提交的位点会越过这条消息
+				commit = b.retryDeadLetter(sub, msg, attempts)
+				break
+			}
+		} else if !p.nacked {
+			break
+		} else if attempts > maxNackRedeliveries {
+			log.Errorf("[kafka]: message [%s/%d/%d] was nacked %d times, give up redelivering", msg.Topic, msg.Partition, msg.Offset, attempts)
+			break
+		}
+
+		// 消息被Nack或者处理失败，按退避策略等待之后重新投递给处理函数
+		if waitContext(sub.context(), b.retryBackoff.duration(attempts-1)) != nil {
+			// 取消订阅时不提交，重新消费时再投递
+			commit = false
+			break
+		}
+		p.nacked = false
+	}
+
+	// 处理成功之后才记录，处理失败的消息重新投递时不会被当作重复消息跳过
+	if sub.dedup != nil && err == nil && !p.nacked {
+		sub.dedup.Record(m)
+	}
+
+	// 处理超时的消息不提交
+	if sub.opts.AutoAck && commit && !errors.Is(err, ErrHandlerTimeout) {
+		if err := p.Ack(); err != nil {
+			log.Errorf("[kafka]: unable to commit msg: %v", err)
+		}
+	}
+
+	b.finishConsumerSpan(span)
 }
 
-func (b *kafkaBroker) Subscribe(topic string, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
-	options := broker.SubscribeOptions{
-		Context: context.Background(),
-		AutoAck: true,
-		Queue:   uuid.New().String(),
+// unmarshalBody 解码消息体，设置了WithRawBody时Body是原始的字节数组
+func (b *kafkaBroker) unmarshalBody(sub *subscriber, msg kafkaGo.Message, m *broker.Message) error {
+	if sub.opts.RawBody || sub.binder == nil {
+		m.Body = msg.Value
+	} else {
+		m.Body = sub.binder()
 	}
-	for _, o := range opts {
-		o(&options)
+
+	if sub.opts.RawBody {
+		return nil
 	}
+	return broker.Unmarshal(b.opts.CodecFor(msg.Topic), msg.Value, &m.Body)
+}
 
-	readerConfig := b.readerConfig
-	readerConfig.Topic = topic
-	readerConfig.GroupID = options.Queue
+// unmarshalKey 设置了KeyBinder时解码消息键，失败时返回nil
+func (b *kafkaBroker) unmarshalKey(sub *subscriber, msg kafkaGo.Message) broker.Any {
+	if sub.opts.KeyBinder == nil || sub.opts.RawBody || len(msg.Key) == 0 {
+		return nil
+	}
 
-	sub := &subscriber{
-		opts:    options,
-		topic:   topic,
-		handler: handler,
-		reader:  kafkaGo.NewReader(readerConfig),
+	key := sub.opts.KeyBinder()
+	if err := broker.Unmarshal(b.opts.CodecFor(msg.Topic), msg.Key, &key); err != nil {
+		log.Errorf("[kafka]: unmarshal message key failed: %v", err)
+		return nil
 	}
+	return key
+}
 
-	go func() {
+// consumeBatch 循环拉取一批消息并交给批量处理函数
+func (b *kafkaBroker) consumeBatch(ctx context.Context, sub *subscriber, handler BatchHandler) {
+	maxRecords, maxWait := defaultBatchMaxRecords, defaultBatchMaxWait
+	if value, ok := sub.opts.Context.Value(batchConsumeKey{}).(*batchConsumeValue); ok {
+		if value.MaxRecords > 0 {
+			maxRecords = value.MaxRecords
+		}
+		if value.MaxWait > 0 {
+			maxWait = value.MaxWait
+		}
+	}
 
-		for {
-			select {
-			case <-options.Context.Done():
+	fetch := func(ctx context.Context) (kafkaGo.Message, error) {
+		return sub.getReader().FetchMessage(ctx)
+	}
+
+	for {
+		if !sub.waitResume(ctx) {
+			return
+		}
+
+		batch, err := collectBatch(ctx, fetch, maxRecords, maxWait)
+		if err != nil {
+			// 取消订阅时丢弃未处理的批次，这些消息没有提交，之后会重新投递
+			if ctx.Err() != nil {
 				return
-			default:
-				msg, err := sub.reader.FetchMessage(options.Context)
-				if err != nil {
-					log.Errorf("FetchMessage error: %s", err.Error())
-					continue
-				}
+			}
+			log.Errorf("FetchMessage error: %s", err.Error())
+		}
+		sub.recordFetch(err)
+		if len(batch) == 0 {
+			continue
+		}
 
-				ctx, span := b.startConsumerSpan(options.Context, &msg)
+		sub.updateLag(batch[len(batch)-1])
 
-				m := &broker.Message{
-					Headers: kafkaHeaderToMap(msg.Headers),
-					Body:    nil,
-				}
+		b.processBatch(sub, handler, batch)
+	}
+}
 
-				p := &publication{topic: msg.Topic, reader: sub.reader, m: m, km: msg, ctx: options.Context}
+// collectBatch 拉取第一条消息之后开始计时，攒够maxRecords条或者超过maxWait时返回
+func collectBatch(ctx context.Context, fetch func(context.Context) (kafkaGo.Message, error), maxRecords int, maxWait time.Duration) ([]kafkaGo.Message, error) {
+	msg, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-				if binder != nil {
-					m.Body = binder()
-				} else {
-					m.Body = msg.Value
-				}
+	batch := make([]kafkaGo.Message, 0, maxRecords)
+	batch = append(batch, msg)
 
-				if err := broker.Unmarshal(b.opts.Codec, msg.Value, &m.Body); err != nil {
-					p.err = err
-					log.Errorf("[kafka]: unmarshal message failed: %v", err)
-				}
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
 
-				err = sub.handler(ctx, p)
-				if err != nil {
-					log.Errorf("[kafka]: process message failed: %v", err)
-				}
-				if sub.opts.AutoAck {
-					if err = p.Ack(); err != nil {
-						log.Errorf("[kafka]: unable to commit msg: %v", err)
+	for len(batch) < maxRecords {
+		msg, err = fetch(waitCtx)
+		if err != nil {
+			if waitCtx.Err() != nil && ctx.Err() == nil {
+				// 等待超时，返回已经攒到的消息
+				return batch, nil
+			}
+			return batch, err
+		}
+		batch = append(batch, msg)
+	}
+
+	return batch, nil
+}
+
+func (b *kafkaBroker) processBatch(sub *subscriber, handler BatchHandler, batch []kafkaGo.Message) {
+	ctx := sub.opts.Context
+
+	msgs := make([]*broker.Message, 0, len(batch))
+	// 错误处理函数返回false的消息在各分区中最小的位点，提交时不能越过它
+	var failed map[topicPartition]int64
+	for _, msg := range batch {
+		b.metrics.recordConsume(ctx, msg.Topic, msg.Partition)
+
+		m := &broker.Message{
+			Headers: kafkaHeaderToMap(msg.Headers),
+		}
+		if err := b.unmarshalBody(sub, msg, m); err != nil {
+			log.Errorf("[kafka]: unmarshal message failed: %v", err)
+			// 解析失败的消息交给错误处理函数之后跳过，返回true时随批次一起提交
+			if b.errorHandler != nil {
+				if !b.errorHandler(ctx, m, err) {
+					tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+					if offset, ok := failed[tp]; !ok || msg.Offset < offset {
+						if failed == nil {
+							failed = make(map[topicPartition]int64)
+						}
+						failed[tp] = msg.Offset
 					}
 				}
+				continue
+			}
+		}
+
+		if sub.dedup != nil && sub.dedup.Contains(m) {
+			continue
+		}
 
-				b.finishConsumerSpan(span)
+		msgs = append(msgs, m)
+	}
+
+	if len(msgs) > 0 {
+		if err := handler(ctx, msgs); err != nil {
+			log.Errorf("[kafka]: process batch failed: %v", err)
+			return
+		}
+
+		if sub.dedup != nil {
+			for _, m := range msgs {
+				sub.dedup.Record(m)
 			}
 		}
-	}()
+	}
 
-	return sub, nil
+	if sub.opts.AutoAck {
+		commits := highestOffsets(beforeFailed(batch, failed))
+		if len(commits) == 0 {
+			return
+		}
+		if err := commitWithRetry(ctx, sub.getReader().CommitMessages, sub.commitRetries, b.retryBackoff, commits...); err != nil {
+			log.Errorf("[kafka]: unable to commit batch: %v", err)
+		}
+	}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// beforeFailed 去掉各分区中位点不小于failed的消息，提交时只提交到失败的消息之前
+func beforeFailed(batch []kafkaGo.Message, failed map[topicPartition]int64) []kafkaGo.Message {
+	if len(failed) == 0 {
+		return batch
+	}
+
+	msgs := make([]kafkaGo.Message, 0, len(batch))
+	for _, msg := range batch {
+		if offset, ok := failed[topicPartition{topic: msg.Topic, partition: msg.Partition}]; ok && msg.Offset >= offset {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// highestOffsets 每个分区只保留位点最大的消息，提交它即可提交整个批次
+func highestOffsets(batch []kafkaGo.Message) []kafkaGo.Message {
+	index := make(map[topicPartition]int)
+	var msgs []kafkaGo.Message
+	for _, msg := range batch {
+		tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+		if i, ok := index[tp]; ok {
+			if msg.Offset > msgs[i].Offset {
+				msgs[i] = msg
+			}
+			continue
+		}
+		index[tp] = len(msgs)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// sendToDeadLetter 将多次处理失败的消息原样转发到死信主题，同步等待写入完成，失败时返回错误
+func (b *kafkaBroker) sendToDeadLetter(sub *subscriber, msg kafkaGo.Message, attempts int) error {
+	kMsg := kafkaGo.Message{
+		Topic: sub.deadLetter.Topic,
+		Key:   msg.Key,
+		Value: msg.Value,
+	}
+	kMsg.Headers = append(kMsg.Headers, msg.Headers...)
+	kMsg.Headers = append(kMsg.Headers,
+		kafkaGo.Header{Key: HeaderDeathCount, Value: []byte(strconv.Itoa(attempts))},
+		kafkaGo.Header{Key: HeaderOriginalTopic, Value: []byte(msg.Topic)},
+	)
+
+	// 使用同步的Writer，确认写入死信主题之后才能提交原消息
+	writer := b.createSyncProducer(len(kMsg.Value), broker.NewPublishOptions())
+	err := b.writeMessages(sub.opts.Context, writer, kMsg)
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("send message to dead letter topic [%s] failed: %w", kMsg.Topic, err)
+	}
+	return nil
+}
+
+// retryDeadLetter 按退避策略重试写入死信主题直到成功，取消订阅时放弃并返回false
+func (b *kafkaBroker) retryDeadLetter(sub *subscriber, msg kafkaGo.Message, attempts int) bool {
+	for i := 0; ; i++ {
+		err := b.sendToDeadLetter(sub, msg, attempts)
+		if err == nil {
+			return true
+		}
+		log.Errorf("[kafka]: %v", err)
+
+		if waitContext(sub.context(), b.retryBackoff.duration(i)) != nil {
+			return false
+		}
+	}
 }
 
 func (b *kafkaBroker) onMessage() {
@@ -646,6 +2511,10 @@ func (b *kafkaBroker) onMessage() {
 
 func (b *kafkaBroker) startProducerSpan(ctx context.Context, msg *kafkaGo.Message) trace.Span {
 	if b.producerTracer == nil {
+		// 没有配置链路追踪时，仍然通过消息头传递上下文
+		if b.propagator != nil {
+			b.propagator.Inject(ctx, NewMessageCarrier(msg))
+		}
 		return nil
 	}
 
@@ -678,6 +2547,9 @@ func (b *kafkaBroker) finishProducerSpan(span trace.Span, partition int32, offse
 
 func (b *kafkaBroker) startConsumerSpan(ctx context.Context, msg *kafkaGo.Message) (context.Context, trace.Span) {
 	if b.consumerTracer == nil {
+		if b.propagator != nil {
+			ctx = b.propagator.Extract(ctx, NewMessageCarrier(msg))
+		}
 		return ctx, nil
 	}
 
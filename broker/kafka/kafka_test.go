@@ -1,17 +1,29 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/go-kratos/kratos/v2/encoding"
 	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/stretchr/testify/assert"
 
@@ -245,3 +257,1550 @@ func Test_Subscribe_WithTracer(t *testing.T) {
 
 	<-interrupt
 }
+
+func Test_Publish_Batch(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+
+	_ = b.Init()
+
+	if err := b.Connect(); err != nil {
+		t.Logf("cant connect to broker, skip: %v", err)
+		t.Skip()
+	}
+	defer b.Disconnect()
+
+	var msgs []broker.Any
+	var keys [][]byte
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, api.Hygrothermograph{
+			Humidity:    float64(rand.Intn(100)),
+			Temperature: float64(rand.Intn(100)),
+		})
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	err := b.PublishBatch(testTopic, msgs, WithBatchMessageKeys(keys), WithSyncPublish())
+	assert.Nil(t, err)
+}
+
+func Test_PublishMulti(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+
+	_ = b.Init()
+
+	if err := b.Connect(); err != nil {
+		t.Logf("cant connect to broker, skip: %v", err)
+		t.Skip()
+	}
+	defer b.Disconnect()
+
+	err := b.(Broker).PublishMulti([]string{testTopic, testTopic + ".audit"}, api.Hygrothermograph{
+		Humidity:    float64(rand.Intn(100)),
+		Temperature: float64(rand.Intn(100)),
+	}, WithSyncPublish())
+	assert.Nil(t, err)
+}
+
+func Test_ConsumeCompressed(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		WithCompression(CompressionZstd),
+	)
+
+	_ = b.Init()
+
+	if err := b.Connect(); err != nil {
+		t.Logf("cant connect to broker, skip: %v", err)
+		t.Skip()
+	}
+	defer b.Disconnect()
+
+	in := api.Hygrothermograph{
+		Humidity:    float64(rand.Intn(100)),
+		Temperature: float64(rand.Intn(100)),
+	}
+	result, err := b.PublishWithResult(testTopic, in)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	msgs, err := b.ReadRange(ctx, testTopic, result.Partition, result.Offset, result.Offset+1)
+	assert.Nil(t, err)
+	if assert.Len(t, msgs, 1) {
+		body := msgs[0].Body.(map[string]interface{})
+		assert.Equal(t, in.Humidity, body["humidity"])
+		assert.Equal(t, in.Temperature, body["temperature"])
+	}
+}
+
+func Test_CompressionCodecs(t *testing.T) {
+	payload := []byte(strings.Repeat("kratos-transport", 64))
+
+	for _, name := range []string{CompressionGzip, CompressionSnappy, CompressionLz4, CompressionZstd} {
+		compression, err := parseCompression(name)
+		assert.Nil(t, err)
+
+		codec := compression.Codec()
+		if !assert.NotNil(t, codec, name) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		w := codec.NewWriter(&buf)
+		_, err = w.Write(payload)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+
+		r := codec.NewReader(&buf)
+		out, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Nil(t, r.Close())
+		assert.Equal(t, payload, out, name)
+	}
+}
+
+func Test_PublishWithResult(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+
+	_ = b.Init()
+
+	if err := b.Connect(); err != nil {
+		t.Logf("cant connect to broker, skip: %v", err)
+		t.Skip()
+	}
+	defer b.Disconnect()
+
+	result, err := b.PublishWithResult(testTopic, api.Hygrothermograph{
+		Humidity:    float64(rand.Intn(100)),
+		Temperature: float64(rand.Intn(100)),
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, testTopic, result.Topic)
+		assert.True(t, result.Offset >= 0)
+	}
+}
+
+func Test_BatchError(t *testing.T) {
+	err := &BatchError{Errors: map[int]error{
+		3: errors.New("three"),
+		1: errors.New("one"),
+	}}
+
+	assert.Equal(t, []int{1, 3}, err.Indices())
+	assert.Equal(t, "kafka: 2 messages failed in batch: [1] one; [3] three;", err.Error())
+}
+
+func Test_Init_WithCompression(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCompression(CompressionZstd),
+	)
+	assert.Nil(t, b.Init())
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCompression("brotli"),
+	)
+	assert.NotNil(t, b.Init())
+}
+
+func Test_RetryBackoff(t *testing.T) {
+	backoff := retryBackoff{Initial: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		d := backoff.duration(attempt)
+		assert.GreaterOrEqual(t, d, max/2)
+		assert.Less(t, d, max)
+	}
+}
+
+func Test_ErrorHandler_SkipCommit(t *testing.T) {
+	var handled bool
+	var handlerErr error
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		WithErrorHandler(func(_ context.Context, _ *broker.Message, err error) bool {
+			handlerErr = err
+			return false
+		}),
+	)
+	assert.Nil(t, b.Init())
+
+	sub := &subscriber{
+		opts: broker.NewSubscribeOptions(),
+		binder: func() broker.Any {
+			return &api.Hygrothermograph{}
+		},
+		handler: func(_ context.Context, _ broker.Event) error {
+			handled = true
+			return nil
+		},
+	}
+
+	// 没有reader，一旦提交就会panic
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte("not json")})
+
+	assert.NotNil(t, handlerErr)
+	assert.False(t, handled)
+}
+
+func Test_Subscribe_WithStartTime(t *testing.T) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+
+	_ = b.Init()
+
+	if err := b.Connect(); err != nil {
+		t.Logf("cant connect to broker, skip: %v", err)
+		t.Skip()
+	}
+
+	_, err := b.Subscribe(testTopic,
+		api.RegisterHygrothermographJsonHandler(handleHygrothermograph),
+		api.HygrothermographCreator,
+		broker.WithQueueName(testGroupId),
+		WithStartTime(time.Now().Add(-time.Hour)),
+	)
+	assert.Nil(t, err)
+
+	<-interrupt
+}
+
+func Test_Subscriber_PauseResume(t *testing.T) {
+	sub := &subscriber{}
+	ctx := context.Background()
+
+	assert.True(t, sub.waitResume(ctx))
+
+	sub.Pause()
+
+	resumed := make(chan bool)
+	go func() {
+		resumed <- sub.waitResume(ctx)
+	}()
+
+	select {
+	case <-resumed:
+		assert.Fail(t, "paused subscriber should block")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	sub.Resume()
+	assert.True(t, <-resumed)
+
+	sub.Pause()
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, sub.waitResume(cancelCtx))
+}
+
+func Test_Subscribe_WithStartPaused(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	handler := func(ctx context.Context, event broker.Event) error { return nil }
+
+	sub, err := b.Subscribe(testTopic, handler, nil, broker.WithQueueName(testGroupId), WithStartPaused())
+	assert.Nil(t, err)
+	defer sub.Unsubscribe()
+
+	s := sub.(*subscriber)
+	s.RLock()
+	assert.NotNil(t, s.resume)
+	s.RUnlock()
+
+	sub.(Subscriber).Resume()
+	assert.True(t, s.waitResume(context.Background()))
+}
+
+func Test_Propagation_WithoutTracer(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithPropagation(propagation.Baggage{}),
+	)
+	assert.Nil(t, b.Init())
+
+	member, err := baggage.NewMember("request-id", "abc")
+	assert.Nil(t, err)
+	bag, err := baggage.New(member)
+	assert.Nil(t, err)
+	ctx := baggage.ContextWithBaggage(context.Background(), bag)
+
+	kb := b.(*kafkaBroker)
+
+	msg := kafkaGo.Message{Topic: testTopic}
+	assert.Nil(t, kb.startProducerSpan(ctx, &msg))
+	assert.Equal(t, 1, len(msg.Headers))
+
+	ctx, _ = kb.startConsumerSpan(context.Background(), &msg)
+	assert.Equal(t, "abc", baggage.FromContext(ctx).Member("request-id").Value())
+}
+
+func Test_PartitionWorker(t *testing.T) {
+	for partition := 0; partition < 16; partition++ {
+		msg := kafkaGo.Message{Topic: testTopic, Partition: partition}
+		worker := partitionWorker(msg, 4)
+		assert.True(t, worker >= 0 && worker < 4)
+		assert.Equal(t, worker, partitionWorker(msg, 4))
+	}
+}
+
+func Test_Init_WithTLSFiles(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithTLSFiles("/nonexistent/ca.pem", "", ""),
+	)
+	assert.NotNil(t, b.Init())
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		WithTLSFiles("", "", ""),
+	)
+	assert.Nil(t, b.Init())
+	assert.NotNil(t, b.Options().TLSConfig)
+	assert.Nil(t, kafkaGo.DefaultDialer.TLS)
+}
+
+func Test_Init_WithTLSMinVersion(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithTLSMinVersion(tls.VersionTLS12),
+		WithTLSCipherSuites([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, uint16(tls.VersionTLS12), b.Options().TLSConfig.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, b.Options().TLSConfig.CipherSuites)
+	assert.True(t, b.Options().Secure)
+
+	config := &tls.Config{ServerName: "kafka"}
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithTLSConfig(config),
+		WithTLSMinVersion(tls.VersionTLS13),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, "kafka", b.Options().TLSConfig.ServerName)
+	assert.Equal(t, uint16(0), config.MinVersion)
+
+	for _, opts := range [][]broker.Option{
+		{WithTLSMinVersion(0x0200)},
+		{WithTLSMinVersion(tls.VersionTLS13), WithTLSCipherSuites([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})},
+		{WithTLSCipherSuites([]uint16{0xffff})},
+		{WithTLSMinVersion(tls.VersionTLS12), WithTLSCipherSuites([]uint16{tls.TLS_AES_128_GCM_SHA256})},
+	} {
+		b = NewBroker(append([]broker.Option{broker.WithAddress(testBrokers)}, opts...)...)
+		assert.True(t, errors.Is(b.Init(), ErrInvalidTLSConfig))
+	}
+}
+
+func Test_Init_WithSASLScram(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithSASLScram("user", "pass", "sha512"),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, "SCRAM-SHA-512", b.(*kafkaBroker).readerConfig.Dialer.SASLMechanism.Name())
+	assert.Nil(t, kafkaGo.DefaultDialer.SASLMechanism)
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		WithSASLScram("user", "pass", "md5"),
+	)
+	assert.NotNil(t, b.Init())
+}
+
+func Test_Flush(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+	)
+	assert.Nil(t, b.Init())
+
+	assert.Nil(t, b.Flush(context.Background()))
+
+	kb := b.(*kafkaBroker)
+	atomic.AddInt64(&kb.inflight, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	assert.ErrorIs(t, b.Flush(ctx), context.DeadlineExceeded)
+
+	atomic.AddInt64(&kb.inflight, -1)
+	assert.Nil(t, b.Flush(context.Background()))
+}
+
+func Test_Init_WithWriterConfigFunc(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithBatchSize(10),
+		WithWriterConfigFunc(func(cfg *WriterConfig) {
+			cfg.BatchSize = 100
+		}),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, 100, b.(*kafkaBroker).writerConfig.BatchSize)
+}
+
+func Test_Init_WithReadCommitted(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, kafkaGo.ReadUncommitted, b.(*kafkaBroker).readerConfig.IsolationLevel)
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		WithReadCommitted(),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, kafkaGo.ReadCommitted, b.(*kafkaBroker).readerConfig.IsolationLevel)
+}
+
+func Test_Publication_Accessors(t *testing.T) {
+	now := time.Now()
+	var event broker.Event = &publication{
+		topic: testTopic,
+		km: kafkaGo.Message{
+			Topic:     testTopic,
+			Partition: 3,
+			Offset:    42,
+			Key:       []byte("key"),
+			Time:      now,
+		},
+	}
+
+	kEvent, ok := event.(Event)
+	assert.True(t, ok)
+	assert.Equal(t, 3, kEvent.Partition())
+	assert.Equal(t, int64(42), kEvent.Offset())
+	assert.Equal(t, []byte("key"), kEvent.Key())
+	assert.Equal(t, now, kEvent.Timestamp())
+}
+
+func Test_ActiveSubscriptions(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	handler := func(ctx context.Context, event broker.Event) error { return nil }
+
+	sub1, err := b.Subscribe("topic-a", handler, nil, broker.WithQueueName("group-a"))
+	assert.Nil(t, err)
+	sub2, err := b.Subscribe("topic-b", handler, nil, broker.WithQueueName("group-b"))
+	assert.Nil(t, err)
+
+	infos := b.ActiveSubscriptions()
+	assert.Len(t, infos, 2)
+	assert.Equal(t, "topic-a", infos[0].Topic)
+	assert.Equal(t, "group-a", infos[0].Group)
+	assert.False(t, infos[0].StartedAt.IsZero())
+	assert.Equal(t, "topic-b", infos[1].Topic)
+
+	assert.Nil(t, sub1.Unsubscribe())
+	infos = b.ActiveSubscriptions()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "topic-b", infos[0].Topic)
+
+	assert.Nil(t, sub2.Unsubscribe())
+	assert.Empty(t, b.ActiveSubscriptions())
+}
+
+func Test_Stop(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	handler := func(ctx context.Context, event broker.Event) error { return nil }
+
+	sub, err := b.Subscribe("topic-a", handler, nil)
+	assert.Nil(t, err)
+	_, err = b.Subscribe("topic-b", handler, nil)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	assert.Nil(t, b.Stop(ctx))
+	assert.Empty(t, b.ActiveSubscriptions())
+	assert.Nil(t, sub.Unsubscribe())
+}
+
+func Test_Unsubscribe_GracefulTimeout(t *testing.T) {
+	sub := &subscriber{
+		topic:           testTopic,
+		reader:          kafkaGo.NewReader(kafkaGo.ReaderConfig{Brokers: []string{testBrokers}, Topic: testTopic}),
+		done:            make(chan struct{}),
+		gracefulTimeout: time.Millisecond * 50,
+	}
+
+	// 处理函数中同步调用Unsubscribe时done不会关闭，等待到超时后返回
+	start := time.Now()
+	assert.Nil(t, sub.Unsubscribe())
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_CommitRetries(t *testing.T) {
+	backoff := retryBackoff{Initial: time.Millisecond, Max: time.Millisecond, Factor: 1}
+
+	var calls int
+	commit := func(_ context.Context, msgs ...kafkaGo.Message) error {
+		calls++
+		if calls < 3 {
+			return errors.New("coordinator not available")
+		}
+		return nil
+	}
+
+	assert.Nil(t, commitWithRetry(context.Background(), commit, 2, backoff, kafkaGo.Message{}))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	assert.NotNil(t, commitWithRetry(context.Background(), commit, 1, backoff, kafkaGo.Message{}))
+	assert.Equal(t, 2, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	assert.NotNil(t, commitWithRetry(ctx, commit, 5, backoff, kafkaGo.Message{}))
+	assert.Equal(t, 1, calls)
+}
+
+func Test_KeyBinder(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+	assert.Nil(t, b.Init())
+
+	type compositeKey struct {
+		Region string `json:"region"`
+		ID     int    `json:"id"`
+	}
+
+	var key broker.Any
+	sub := &subscriber{
+		opts: broker.NewSubscribeOptions(
+			broker.DisableAutoAck(),
+			broker.WithKeyBinder(func() broker.Any { return &compositeKey{} }),
+		),
+		handler: func(_ context.Context, event broker.Event) error {
+			key = event.(Event).TypedKey()
+			return nil
+		},
+	}
+
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{
+		Topic: testTopic,
+		Key:   []byte(`{"region":"eu","id":7}`),
+		Value: []byte(`{}`),
+	})
+	assert.Equal(t, &compositeKey{Region: "eu", ID: 7}, key)
+
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte(`{}`)})
+	assert.Nil(t, key)
+}
+
+func Test_SubscribeTyped(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+	)
+	assert.Nil(t, b.Init())
+
+	received := make(chan *api.Hygrothermograph, 1)
+	sub, err := SubscribeTyped(b, testTopic, func(_ context.Context, msg *api.Hygrothermograph) error {
+		received <- msg
+		return nil
+	}, broker.DisableAutoAck())
+	assert.Nil(t, err)
+	defer sub.Unsubscribe()
+
+	s := sub.(*subscriber)
+	b.(*kafkaBroker).processMessage(s, kafkaGo.Message{
+		Topic: testTopic,
+		Value: []byte(`{"humidity":48.5,"temperature":21.25}`),
+	})
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, &api.Hygrothermograph{Humidity: 48.5, Temperature: 21.25}, msg)
+	case <-time.After(time.Second):
+		assert.Fail(t, "message should be received within 1 second")
+	}
+}
+
+func Test_ProducerInterceptor(t *testing.T) {
+	var topics []string
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		broker.WithProducerInterceptor(func(next broker.PublishFunc) broker.PublishFunc {
+			return func(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+				topics = append(topics, topic)
+				// 不调用next，消息被丢弃，不会连接Kafka
+				return nil
+			}
+		}),
+	)
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	assert.Nil(t, b.Publish(testTopic, &api.Hygrothermograph{}))
+	assert.Nil(t, kb.PublishSync(testTopic, &api.Hygrothermograph{}))
+	assert.Nil(t, kb.PublishRaw(testTopic, []byte("raw")))
+	assert.Nil(t, kb.PublishBatch(testTopic, []broker.Any{&api.Hygrothermograph{}, &api.Hygrothermograph{}}))
+	assert.Nil(t, kb.PublishMulti([]string{testTopic, "other"}, &api.Hygrothermograph{}))
+
+	_, err := kb.PublishWithResult(testTopic, &api.Hygrothermograph{})
+	assert.True(t, errors.Is(err, ErrMessageDropped))
+
+	assert.Equal(t, []string{testTopic, testTopic, testTopic, testTopic, testTopic, testTopic, "other", testTopic}, topics)
+}
+
+func Test_SameMessage(t *testing.T) {
+	msg := &api.Hygrothermograph{}
+	assert.True(t, sameMessage(msg, msg))
+	assert.False(t, sameMessage(msg, &api.Hygrothermograph{}))
+	assert.False(t, sameMessage([]byte("a"), []byte("a")))
+	assert.False(t, sameMessage(nil, nil))
+}
+
+func Test_HandlerTimeout(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	cancelled := make(chan struct{})
+	sub := &subscriber{
+		opts:           broker.NewSubscribeOptions(),
+		handlerTimeout: time.Millisecond * 50,
+		handler: func(ctx context.Context, _ broker.Event) error {
+			<-ctx.Done()
+			close(cancelled)
+			time.Sleep(time.Millisecond * 100)
+			return nil
+		},
+	}
+
+	// 没有reader，超时之后如果提交就会panic
+	start := time.Now()
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic})
+	assert.Less(t, time.Since(start), time.Millisecond*100)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "handler context should be cancelled")
+	}
+}
+
+func Test_NackRedelivery(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithRetryBackoff(time.Millisecond, time.Millisecond, 1),
+	)
+	assert.Nil(t, b.Init())
+
+	var calls int
+	opts := broker.NewSubscribeOptions()
+	opts.AutoAck = false
+	sub := &subscriber{
+		opts: opts,
+		handler: func(_ context.Context, event broker.Event) error {
+			calls++
+			return event.(Event).Nack()
+		},
+	}
+
+	// 一直Nack的消息重新投递的次数有上限，不会阻塞分区
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte(`{}`)})
+	assert.Equal(t, maxNackRedeliveries+1, calls)
+
+	// 取消订阅时不再等待重新投递
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	sub.ctx = ctx
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte(`{}`)})
+	assert.Equal(t, 1, calls)
+}
+
+func Test_DeadLetterRetry(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress("127.0.0.1:1"),
+		WithRetryBackoff(time.Millisecond, time.Millisecond*10, 2),
+		WithMaxAttempts(1),
+	)
+	assert.Nil(t, b.Init())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+
+	var calls int
+	opts := broker.NewSubscribeOptions()
+	sub := &subscriber{
+		ctx:        ctx,
+		opts:       opts,
+		deadLetter: &deadLetterValue{Topic: testTopic + "-dlq", MaxRetries: 1},
+		handler: func(_ context.Context, _ broker.Event) error {
+			calls++
+			return errors.New("failed")
+		},
+	}
+
+	// 写入死信主题一直失败时持续重试，取消订阅时放弃且不提交（sub没有Reader，提交会panic）
+	start := time.Now()
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte(`{}`)})
+	assert.Equal(t, 1, calls)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*500)
+}
+
+func Test_RebalanceHandler(t *testing.T) {
+	var gens [][2]int
+	var logged int
+	l := &rebalanceLogger{
+		next: kafkaGo.LoggerFunc(func(string, ...interface{}) { logged++ }),
+		handler: func(oldGen, newGen int) {
+			gens = append(gens, [2]int{oldGen, newGen})
+		},
+	}
+
+	l.Printf(joinedGroupFormat, testGroupId, "member-1", int32(1))
+	l.Printf(joinedGroupFormat, testGroupId, "member-1", int32(1))
+	l.Printf("entering loop for consumer group, %v\n", testGroupId)
+	l.Printf(joinedGroupFormat, testGroupId, "member-1", int32(3))
+
+	assert.Equal(t, [][2]int{{0, 1}, {1, 3}}, gens)
+	assert.Equal(t, 4, logged)
+}
+
+func Test_RebalanceLogger_KafkaGoFormat(t *testing.T) {
+	// RebalanceHandler依赖kafka-go加入消费组时输出的日志，升级kafka-go时需要确认日志格式没有变化再修改这里的版本
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/segmentio/kafka-go" {
+				assert.Equal(t, "v0.4.42", dep.Version)
+			}
+		}
+	}
+
+	var gens [][2]int
+	l := &rebalanceLogger{
+		handler: func(oldGen, newGen int) {
+			gens = append(gens, [2]int{oldGen, newGen})
+		},
+	}
+
+	// kafka-go v0.4.42 consumergroup.go中输出的两条日志
+	l.Printf("joined group %s as member %s in generation %d", testGroupId, "member-1", int32(1))
+	l.Printf("Joined group %s as member %s in generation %d", testGroupId, "member-1", int32(1))
+	l.Printf("joined group %s as member %s in generation %d", testGroupId, "member-1", int32(2))
+	l.Printf("Joined group %s as member %s in generation %d", testGroupId, "member-1", int32(2))
+
+	assert.Equal(t, [][2]int{{0, 1}, {1, 2}}, gens)
+}
+
+func Test_RawBody(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		WithErrorHandler(func(_ context.Context, _ *broker.Message, err error) bool {
+			assert.Fail(t, "raw body should not be unmarshalled")
+			return false
+		}),
+	)
+	assert.Nil(t, b.Init())
+
+	var body interface{}
+	sub := &subscriber{
+		opts: broker.NewSubscribeOptions(broker.WithRawBody(), broker.DisableAutoAck()),
+		binder: func() broker.Any {
+			return &api.Hygrothermograph{}
+		},
+		handler: func(_ context.Context, event broker.Event) error {
+			body = event.Message().Body
+			return nil
+		},
+	}
+
+	b.(*kafkaBroker).processMessage(sub, kafkaGo.Message{Topic: testTopic, Value: []byte("not json")})
+
+	assert.Equal(t, []byte("not json"), body)
+}
+
+func Test_BatchConsume(t *testing.T) {
+	msgs := make(chan kafkaGo.Message, 10)
+	fetch := func(ctx context.Context) (kafkaGo.Message, error) {
+		select {
+		case msg := <-msgs:
+			return msg, nil
+		case <-ctx.Done():
+			return kafkaGo.Message{}, ctx.Err()
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		msgs <- kafkaGo.Message{Topic: testTopic, Partition: i % 2, Offset: int64(i)}
+	}
+
+	ctx := context.Background()
+
+	batch, err := collectBatch(ctx, fetch, 3, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, batch, 3)
+
+	// 消息不足maxRecords时等待maxWait之后返回
+	start := time.Now()
+	batch, err = collectBatch(ctx, fetch, 3, time.Millisecond*100)
+	assert.Nil(t, err)
+	assert.Len(t, batch, 2)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*100)
+
+	commits := highestOffsets([]kafkaGo.Message{
+		{Topic: testTopic, Partition: 0, Offset: 1},
+		{Topic: testTopic, Partition: 1, Offset: 5},
+		{Topic: testTopic, Partition: 0, Offset: 3},
+		{Topic: testTopic, Partition: 1, Offset: 4},
+	})
+	assert.Len(t, commits, 2)
+	assert.Equal(t, int64(3), commits[0].Offset)
+	assert.Equal(t, int64(5), commits[1].Offset)
+
+	// 分区0中位点2的消息错误处理函数返回false，只提交到它之前，分区1不受影响
+	commits = highestOffsets(beforeFailed([]kafkaGo.Message{
+		{Topic: testTopic, Partition: 0, Offset: 1},
+		{Topic: testTopic, Partition: 0, Offset: 2},
+		{Topic: testTopic, Partition: 1, Offset: 5},
+		{Topic: testTopic, Partition: 0, Offset: 3},
+	}, map[topicPartition]int64{{topic: testTopic, partition: 0}: 2}))
+	assert.Len(t, commits, 2)
+	assert.Equal(t, int64(1), commits[0].Offset)
+	assert.Equal(t, int64(5), commits[1].Offset)
+
+	commits = highestOffsets(beforeFailed([]kafkaGo.Message{
+		{Topic: testTopic, Partition: 0, Offset: 1},
+	}, map[topicPartition]int64{{topic: testTopic, partition: 0}: 1}))
+	assert.Empty(t, commits)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	batch, err = collectBatch(cancelled, fetch, 3, time.Second)
+	assert.NotNil(t, err)
+	assert.Empty(t, batch)
+
+	b := NewBroker(broker.WithAddress(testBrokers))
+	_, err = b.(Broker).SubscribeBatch(testTopic, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_AutoReconnect(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithAutoReconnect(true),
+		WithRetryBackoff(time.Millisecond, time.Millisecond, 1),
+	)
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	assert.True(t, kb.autoReconnect)
+
+	readerConfig := kafkaGo.ReaderConfig{Brokers: []string{testBrokers}, Topic: testTopic}
+	old := kafkaGo.NewReader(readerConfig)
+	sub := &subscriber{
+		topic:        testTopic,
+		opts:         broker.NewSubscribeOptions(),
+		reader:       old,
+		readerConfig: readerConfig,
+		next:         10,
+	}
+
+	ctx := context.Background()
+	assert.True(t, kb.reconnectReader(ctx, sub, 0))
+	assert.NotSame(t, old, sub.getReader())
+	assert.Equal(t, int64(10), sub.getReader().Offset())
+
+	assert.Nil(t, sub.closeReader())
+	assert.False(t, kb.reconnectReader(ctx, sub, 0))
+
+	writer := kb.getWriter(testTopic, 0, broker.NewPublishOptions())
+	kb.resetWriter(writer)
+	_, ok := kb.writer.get(testTopic)
+	assert.False(t, ok)
+}
+
+func Test_Dedup(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	var handled int
+	opts := broker.NewSubscribeOptions(
+		broker.DisableAutoAck(),
+		broker.WithDedup(func(msg *broker.Message) string {
+			return msg.Headers["id"]
+		}, time.Minute),
+	)
+	sub := &subscriber{
+		opts:  opts,
+		dedup: broker.NewDedupFromContext(opts.Context),
+		handler: func(_ context.Context, event broker.Event) error {
+			handled++
+			if event.Message().Headers["id"] == "3" && handled == 3 {
+				return errors.New("handle failed")
+			}
+			return nil
+		},
+	}
+
+	msg := func(id string) kafkaGo.Message {
+		return kafkaGo.Message{Topic: testTopic, Headers: []kafkaGo.Header{{Key: "id", Value: []byte(id)}}}
+	}
+
+	b.(*kafkaBroker).processMessage(sub, msg("1"))
+	b.(*kafkaBroker).processMessage(sub, msg("1"))
+	b.(*kafkaBroker).processMessage(sub, msg("2"))
+
+	assert.Equal(t, 2, handled)
+
+	// 处理失败的消息没有记录，重新投递时仍然交给处理函数
+	b.(*kafkaBroker).processMessage(sub, msg("3"))
+	b.(*kafkaBroker).processMessage(sub, msg("3"))
+	b.(*kafkaBroker).processMessage(sub, msg("3"))
+
+	assert.Equal(t, 4, handled)
+}
+
+func Test_HeaderCodec(t *testing.T) {
+	type EventMeta struct {
+		Source  string
+		Version int
+	}
+	meta := EventMeta{Source: "sensor", Version: 2}
+
+	for _, codec := range []string{"", "json"} {
+		opts := []broker.Option{broker.WithAddress(testBrokers)}
+		if codec != "" {
+			opts = append(opts, WithHeaderCodec(codec))
+		}
+		b := NewBroker(opts...).(*kafkaBroker)
+		assert.Nil(t, b.Init())
+
+		kMsg := b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions(
+			WithHeaders(map[string]interface{}{"meta": meta, "trace": "abc"}),
+		))
+
+		p := &publication{km: kMsg, headerCodec: b.headerCodec}
+
+		var out EventMeta
+		assert.Nil(t, p.Header("meta", &out), codec)
+		assert.Equal(t, meta, out)
+
+		assert.True(t, errors.Is(p.Header("missing", &out), ErrHeaderNotFound))
+	}
+
+	b := NewBroker(WithHeaderCodec("unknown"))
+	assert.NotNil(t, b.Init())
+}
+
+func Test_WithPartition(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers)).(*kafkaBroker)
+	assert.Nil(t, b.Init())
+
+	options := broker.NewPublishOptions(WithPartition(3), WithMessageKey([]byte("key")))
+	assert.Nil(t, checkPartition(options))
+
+	kMsg := b.newKafkaMessage(testTopic, nil, options)
+	assert.Equal(t, 3, kMsg.Partition)
+
+	writer := b.createSyncProducer(0, options)
+	assert.Equal(t, 3, writer.Balancer.Balance(kMsg, 0, 1, 2, 3))
+	// 主题只有3个分区时回退到默认的均衡器
+	assert.Contains(t, []int{0, 1, 2}, writer.Balancer.Balance(kMsg, 0, 1, 2))
+
+	kMsg = b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions())
+	assert.Contains(t, []int{0, 1, 2, 3}, writer.Balancer.Balance(kMsg, 0, 1, 2, 3))
+	assert.True(t, kMsg.Time.IsZero())
+
+	createTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	kMsg = b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions(WithMessageTime(createTime)))
+	assert.Equal(t, createTime, kMsg.Time)
+
+	assert.Equal(t, ErrInvalidPartition, checkPartition(broker.NewPublishOptions(WithPartition(-1))))
+	assert.Equal(t, ErrPartitionConflict, checkPartition(broker.NewPublishOptions(WithPartition(1), WithHashBalancer(nil))))
+	assert.Equal(t, ErrPartitionConflict, b.Publish(testTopic, "msg", WithPartition(1), WithMurmur2Balancer(true)))
+}
+
+func Test_CircuitBreaker(t *testing.T) {
+	now := time.Now()
+	c := newCircuitBreaker(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	failed := errors.New("failed")
+
+	assert.Nil(t, c.allow())
+	c.record(failed)
+	assert.Equal(t, CircuitClosed, c.State())
+	assert.Nil(t, c.allow())
+	c.record(failed)
+	assert.Equal(t, CircuitOpen, c.State())
+	assert.Equal(t, ErrCircuitOpen, c.allow())
+
+	// 冷却时间结束后只放行一次探测
+	now = now.Add(time.Minute)
+	assert.Equal(t, CircuitHalfOpen, c.State())
+	assert.Nil(t, c.allow())
+	assert.Equal(t, ErrCircuitOpen, c.allow())
+	c.record(failed)
+	assert.Equal(t, CircuitOpen, c.State())
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, c.allow())
+	c.record(nil)
+	assert.Equal(t, CircuitClosed, c.State())
+	assert.Nil(t, c.allow())
+
+	var disabled *circuitBreaker
+	assert.Nil(t, disabled.allow())
+	assert.Equal(t, CircuitClosed, disabled.State())
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCircuitBreaker(1, time.Hour),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, CircuitClosed, b.CircuitState())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.PublishSync(testTopic, "msg", broker.WithPublishContext(ctx)); err == nil {
+		t.Skip("kafka is available, skip")
+	}
+	assert.Equal(t, CircuitOpen, b.CircuitState())
+	assert.Equal(t, ErrCircuitOpen, b.PublishSync(testTopic, "msg"))
+	assert.Equal(t, ErrCircuitOpen, b.Publish(testTopic, "msg"))
+}
+
+func Test_CorrelationID(t *testing.T) {
+	type correlationKey struct{}
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCorrelationIDKey(correlationKey{}),
+	).(*kafkaBroker)
+	assert.Nil(t, b.Init())
+
+	ctx := context.WithValue(context.Background(), correlationKey{}, "req-1")
+	kMsg := b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions(broker.WithPublishContext(ctx)))
+	assert.Equal(t, []kafkaGo.Header{{Key: HeaderCorrelationID, Value: []byte("req-1")}}, kMsg.Headers)
+
+	// 显式设置的消息头优先
+	kMsg = b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions(
+		broker.WithPublishContext(ctx),
+		WithHeaders(map[string]interface{}{HeaderCorrelationID: "req-2"}),
+	))
+	assert.Len(t, kMsg.Headers, 1)
+	assert.Equal(t, []byte("req-2"), kMsg.Headers[0].Value)
+
+	kMsg = b.newKafkaMessage(testTopic, nil, broker.NewPublishOptions())
+	assert.Len(t, kMsg.Headers, 0)
+
+	var id interface{}
+	sub := &subscriber{
+		opts: broker.NewSubscribeOptions(broker.DisableAutoAck()),
+		handler: func(ctx context.Context, _ broker.Event) error {
+			id = ctx.Value(correlationKey{})
+			return nil
+		},
+	}
+	b.processMessage(sub, kafkaGo.Message{
+		Topic:   testTopic,
+		Headers: []kafkaGo.Header{{Key: HeaderCorrelationID, Value: []byte("req-3")}},
+	})
+	assert.Equal(t, "req-3", id)
+}
+
+func Test_MessageAttempts(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers)).(*kafkaBroker)
+	assert.Nil(t, b.Init())
+
+	assert.Equal(t, 1, MessageAttempts(kafkaGo.Message{}))
+
+	options := broker.NewPublishOptions()
+	kMsg := b.newKafkaMessage(testTopic, []byte("msg"), options)
+	assert.Equal(t, 0, MessageAttempts(kMsg))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	writer := b.createSyncProducer(0, options)
+	defer writer.Close()
+
+	// 不论写入是否成功都会计数
+	_ = b.writeMessages(ctx, writer, kMsg)
+	_ = b.writeMessages(ctx, writer, kMsg)
+	assert.Equal(t, 2, MessageAttempts(kMsg))
+
+	assert.False(t, isTemporaryError(context.DeadlineExceeded))
+	assert.True(t, isTemporaryError(kafkaGo.LeaderNotAvailable))
+	assert.False(t, isTemporaryError(kafkaGo.RequestTimedOut))
+}
+
+func Test_WriterStats(t *testing.T) {
+	topics := make(chan string, 10)
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithWriterStatsHandler(func(topic string, stats kafkaGo.WriterStats) {
+			select {
+			case topics <- topic:
+			default:
+			}
+		}, time.Millisecond*20),
+	).(*kafkaBroker)
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	defer b.Disconnect()
+
+	assert.Equal(t, kafkaGo.WriterStats{}, b.WriterStats(testTopic))
+
+	b.Lock()
+	b.writer.set(testTopic, b.createCachedProducer(b.writer, broker.NewPublishOptions()))
+	b.Unlock()
+
+	assert.Equal(t, int64(0), b.WriterStats(testTopic).Errors)
+
+	select {
+	case topic := <-topics:
+		assert.Equal(t, testTopic, topic)
+	case <-time.After(time.Second):
+		assert.Fail(t, "writer stats handler should be called")
+	}
+}
+
+func Test_SubscribeStartOffset(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithStartOffset(kafkaGo.LastOffset),
+	)
+	assert.Nil(t, b.Init())
+
+	handler := func(ctx context.Context, event broker.Event) error { return nil }
+
+	sub, err := b.Subscribe(testTopic, handler, nil,
+		broker.WithQueueName(testGroupId),
+		WithSubscribeStartOffset(kafkaGo.FirstOffset),
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, kafkaGo.FirstOffset, sub.(*subscriber).reader.Config().StartOffset)
+	assert.Nil(t, sub.Unsubscribe())
+
+	sub, err = b.Subscribe(testTopic, handler, nil, broker.WithQueueName(testGroupId))
+	assert.Nil(t, err)
+	assert.Equal(t, kafkaGo.LastOffset, sub.(*subscriber).reader.Config().StartOffset)
+	assert.Nil(t, sub.Unsubscribe())
+}
+
+func Test_SubscribePartition(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	handler := func(ctx context.Context, event broker.Event) error { return nil }
+
+	_, err := b.SubscribePartition(testTopic, -1, kafkaGo.FirstOffset, handler, nil)
+	assert.Equal(t, ErrInvalidPartition, err)
+
+	sub, err := b.SubscribePartition(testTopic, 3, kafkaGo.LastOffset, handler, nil, broker.WithQueueName(testGroupId))
+	assert.Nil(t, err)
+	assert.False(t, sub.Options().AutoAck)
+	assert.Equal(t, 3, sub.(*subscriber).reader.Config().Partition)
+	assert.Equal(t, "", sub.(*subscriber).reader.Config().GroupID)
+
+	infos := b.ActiveSubscriptions()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "", infos[0].Group)
+
+	assert.Nil(t, sub.Unsubscribe())
+}
+
+func Test_ReadRange(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	ctx := context.Background()
+
+	_, err := b.ReadRange(ctx, testTopic, -1, 0, 10)
+	assert.Equal(t, ErrInvalidPartition, err)
+
+	msgs, err := b.ReadRange(ctx, testTopic, 0, 10, 10)
+	assert.Nil(t, err)
+	assert.Len(t, msgs, 0)
+}
+
+func Test_PublishAfterDisconnect(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		WithMaxMessageBytes(16),
+	)
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	assert.Nil(t, b.Disconnect())
+
+	assert.True(t, errors.Is(b.Publish(testTopic, "x"), ErrNotConnected))
+	assert.True(t, errors.Is(b.PublishBatch(testTopic, []broker.Any{"x"}), ErrNotConnected))
+	assert.True(t, errors.Is(b.PublishMulti([]string{testTopic}, "x"), ErrNotConnected))
+	_, err := b.PublishWithResult(testTopic, "x")
+	assert.True(t, errors.Is(err, ErrNotConnected))
+
+	// 重新连接后可以继续发送
+	assert.Nil(t, b.Connect())
+	assert.True(t, errors.Is(b.Publish(testTopic, strings.Repeat("x", 32)), ErrMessageTooLarge))
+
+	_, err = b.SubscribeTopics(nil, nil, nil)
+	assert.True(t, errors.Is(err, ErrNoTopics))
+	_, err = b.SubscribeBatch(testTopic, nil, nil)
+	assert.True(t, errors.Is(err, ErrNilHandler))
+}
+
+func Test_MaxMessageBytes(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		WithMaxMessageBytes(16),
+	)
+	assert.Nil(t, b.Init())
+
+	err := b.Publish(testTopic, strings.Repeat("x", 32))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	assert.Contains(t, err.Error(), "34 bytes exceeds the limit of 16 bytes")
+
+	err = b.(Broker).PublishMulti([]string{testTopic, "audit"}, strings.Repeat("x", 32))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	assert.Nil(t, b.(Broker).PublishMulti(nil, strings.Repeat("x", 32)))
+
+	err = b.(Broker).PublishRaw(testTopic, []byte(strings.Repeat("x", 17)))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	assert.Contains(t, err.Error(), "17 bytes exceeds the limit of 16 bytes")
+
+	err = b.PublishBatch(testTopic, []broker.Any{strings.Repeat("x", 32)})
+	var batchErr *BatchError
+	assert.True(t, errors.As(err, &batchErr))
+	assert.True(t, errors.Is(batchErr.Errors[0], ErrMessageTooLarge))
+}
+
+func Test_NewBroker_WithBalancerInstance(t *testing.T) {
+	balancer := &kafkaGo.RoundRobin{}
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithBalancerInstance(balancer),
+	)
+	// 不需要等到Init
+	assert.Equal(t, balancer, b.(*kafkaBroker).writerConfig.Balancer)
+	assert.True(t, b.(*kafkaBroker).customBalancer)
+
+	assert.Nil(t, b.Init())
+	assert.Equal(t, balancer, b.(*kafkaBroker).writerConfig.Balancer)
+
+	b = NewBroker(broker.WithAddress(testBrokers))
+	assert.IsType(t, &kafkaGo.LeastBytes{}, b.(*kafkaBroker).writerConfig.Balancer)
+	assert.False(t, b.(*kafkaBroker).customBalancer)
+}
+
+func Test_Init_WithRequiredAcks(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithRequiredAcks(RequiredAcksAll),
+	)
+	assert.Nil(t, b.Init())
+	assert.Equal(t, kafkaGo.RequireAll, b.(*kafkaBroker).writerConfig.RequiredAcks)
+
+	b = NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+	assert.Equal(t, kafkaGo.RequireNone, b.(*kafkaBroker).writerConfig.RequiredAcks)
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		WithRequiredAcks("quorum"),
+	)
+	assert.NotNil(t, b.Init())
+}
+
+func Test_KratosLogger(t *testing.T) {
+	var buf strings.Builder
+	logger := log.NewStdLogger(&buf)
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithKratosLogger(logger),
+	).(*kafkaBroker)
+	assert.Nil(t, b.Init())
+
+	b.readerConfig.ErrorLogger.Printf("fetch failed: %s", "eof")
+	assert.Contains(t, buf.String(), "ERROR")
+	assert.Contains(t, buf.String(), "fetch failed: eof")
+
+	buf.Reset()
+	b.logger.With("topic", testTopic, "partition", 3).Printf("committed offset %d", 10)
+	assert.Contains(t, buf.String(), "DEBUG")
+	assert.Contains(t, buf.String(), "topic="+testTopic)
+	assert.Contains(t, buf.String(), "partition=3")
+	assert.Contains(t, buf.String(), "committed offset 10")
+}
+
+func Test_NewCollector(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCircuitBreaker(1, time.Minute),
+	)
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	kb.addSubscriber(&subscriber{topic: testTopic, opts: broker.SubscribeOptions{Queue: testGroupId}, lag: 3})
+	kb.addSubscriber(&subscriber{topic: testTopic, opts: broker.SubscribeOptions{Queue: testGroupId}, lag: 4})
+	kb.breaker.record(errors.New("failed"))
+
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(NewCollector(b)))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			values[family.GetName()] += m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, float64(7), values["kafka_reader_lag"])
+	assert.Equal(t, float64(CircuitOpen), values["kafka_circuit_state"])
+	assert.Equal(t, float64(0), values["kafka_publish_inflight"])
+
+	// 不是Kafka的Broker时不采集指标
+	assert.Nil(t, prometheus.NewPedanticRegistry().Register(NewCollector(nil)))
+}
+
+func Test_PublishMulti_TopicCodec(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithCodec("json"),
+		broker.WithTopicCodec("proto.topic", "proto"),
+	)
+	assert.Nil(t, b.Init())
+
+	opts := b.Options()
+	assert.Equal(t, encoding.GetCodec("proto"), opts.CodecFor("proto.topic"))
+	assert.Equal(t, encoding.GetCodec("json"), opts.CodecFor(testTopic))
+
+	err := b.PublishMulti([]string{testTopic, "proto.topic"}, &api.Hygrothermograph{})
+	assert.ErrorIs(t, err, ErrCodecMismatch)
+
+	b = NewBroker(
+		broker.WithAddress(testBrokers),
+		broker.WithTopicCodec("yaml.topic", "unknown"),
+	)
+	assert.ErrorIs(t, b.Init(), broker.ErrUnknownCodec)
+}
+
+func Test_TopicAdmin(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	ctx := context.Background()
+	topic := fmt.Sprintf("test.admin.%d", time.Now().UnixNano())
+
+	exists, err := b.TopicExists(ctx, topic)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	err = b.CreateTopic(ctx, topic, 3, 1, map[string]string{"retention.ms": "60000"})
+	assert.Nil(t, err)
+
+	err = b.CreateTopic(ctx, topic, 3, 1, nil)
+	assert.True(t, errors.Is(err, kafkaGo.TopicAlreadyExists))
+
+	exists, err = b.TopicExists(ctx, topic)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	assert.Nil(t, b.DeleteTopic(ctx, topic))
+}
+
+func Test_ResetOffsets(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	ctx := context.Background()
+	group := fmt.Sprintf("test.reset.%d", time.Now().UnixNano())
+
+	assert.Nil(t, b.ResetOffsets(ctx, testTopic, group, OffsetEarliest))
+	assert.Nil(t, b.ResetOffsets(ctx, testTopic, group, OffsetAtTime(time.Now().Add(-time.Hour))))
+	assert.Nil(t, b.ResetOffsets(ctx, testTopic, group, OffsetLatest))
+}
+
+func Test_CompressionThreshold(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithCompression(CompressionGzip),
+		WithCompressionThreshold(64),
+	)
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	options := broker.NewPublishOptions()
+
+	small := kb.getWriter(testTopic, 64, options)
+	large := kb.getWriter(testTopic, 65, options)
+	assert.NotSame(t, small, large)
+	assert.Equal(t, kafkaGo.Compression(0), small.Compression)
+	assert.Equal(t, kafkaGo.Gzip, large.Compression)
+	assert.Same(t, small, kb.getWriter(testTopic, 1, options))
+
+	sync := kb.createSyncProducer(1, options)
+	assert.Equal(t, kafkaGo.Compression(0), sync.Compression)
+	_ = sync.Close()
+
+	var count int
+	kb.writer.Range(func(topic string, writer *kafkaGo.Writer) {
+		count++
+	})
+	assert.Equal(t, 2, count)
+
+	// 没有设置压缩算法时不创建不压缩的Writer
+	b = NewBroker(broker.WithAddress(testBrokers), WithCompressionThreshold(64))
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.(*kafkaBroker).writer.Uncompressed)
+}
+
+func Test_WithResolver(t *testing.T) {
+	var calls int32
+	resolver := func(ctx context.Context) ([]string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return []string{"kafka-0:9092"}, nil
+		}
+		return []string{"kafka-0:9092", "kafka-1:9092"}, nil
+	}
+
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithResolver(resolver, 10*time.Millisecond),
+	)
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	defer b.Disconnect()
+
+	kb := b.(*kafkaBroker)
+	brokers := func() []string {
+		kb.RLock()
+		defer kb.RUnlock()
+		return kb.writerConfig.Brokers
+	}
+	assert.Equal(t, []string{"kafka-0:9092"}, kb.readerConfig.Brokers)
+
+	// 定期重新解析，扩容后的地址对之后创建的Writer生效
+	assert.Eventually(t, func() bool { return len(brokers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	failed := NewBroker(WithResolver(func(ctx context.Context) ([]string, error) {
+		return nil, nil
+	}, 0))
+	assert.Nil(t, failed.Init())
+	assert.True(t, errors.Is(failed.Connect(), ErrNoBrokers))
+}
+
+func Test_SubscriberHealth(t *testing.T) {
+	sub := &subscriber{topic: testTopic, lag: 5}
+
+	h := sub.Health()
+	assert.True(t, h.Healthy)
+	assert.True(t, h.LastFetch.IsZero())
+	assert.Equal(t, int64(5), h.Lag)
+
+	failed := errors.New("fetch failed")
+	sub.recordFetch(failed)
+	sub.recordFetch(failed)
+	h = sub.Health()
+	assert.False(t, h.Healthy)
+	assert.Equal(t, failed, h.LastError)
+	assert.Equal(t, 2, h.Failures)
+
+	sub.recordFetch(nil)
+	h = sub.Health()
+	assert.True(t, h.Healthy)
+	assert.Nil(t, h.LastError)
+	assert.Equal(t, 0, h.Failures)
+	assert.False(t, h.LastFetch.IsZero())
+
+	// 有积压的消息但是长时间没有拉取到消息时视为停滞
+	sub.healthStaleness = time.Minute
+	assert.True(t, sub.Health().Healthy)
+	sub.lastFetch = time.Now().Add(-time.Hour)
+	h = sub.Health()
+	assert.False(t, h.Healthy)
+	assert.True(t, h.Stale)
+
+	// 没有积压的消息时，主题空闲不算停滞
+	sub.updateLag(kafkaGo.Message{Offset: 9, HighWaterMark: 10})
+	assert.True(t, sub.Health().Healthy)
+
+	sub.lag = 5
+	sub.Pause()
+	h = sub.Health()
+	assert.True(t, h.Paused)
+	assert.True(t, h.Healthy)
+
+	assert.True(t, sub.stop())
+	assert.False(t, sub.Health().Healthy)
+}
+
+func Test_CommitMode(t *testing.T) {
+	b := NewBroker(
+		broker.WithAddress(testBrokers),
+		WithAsyncCommit(0),
+	)
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	assert.Equal(t, time.Second, kb.readerConfig.CommitInterval)
+
+	// 以最后设置的为准
+	assert.Nil(t, b.Init(WithSyncCommit()))
+	assert.Equal(t, time.Duration(0), kb.readerConfig.CommitInterval)
+
+	assert.Nil(t, b.Init(WithAsyncCommit(5*time.Second)))
+	assert.Equal(t, 5*time.Second, kb.readerConfig.CommitInterval)
+}
+
+func Test_Init_ClosesWriters(t *testing.T) {
+	b := NewBroker(broker.WithAddress(testBrokers))
+	assert.Nil(t, b.Init())
+
+	kb := b.(*kafkaBroker)
+	writer := kb.getWriter(testTopic, 0, broker.NewPublishOptions())
+
+	// 再次Init时关闭之前缓存的Writer
+	assert.Nil(t, b.Init())
+	_, ok := kb.writer.get(testTopic)
+	assert.False(t, ok)
+	assert.ErrorIs(t, writer.WriteMessages(context.Background(), kafkaGo.Message{Topic: testTopic}), io.ErrClosedPipe)
+}
@@ -1,6 +1,13 @@
 package kafka
 
-import "github.com/go-kratos/kratos/v2/log"
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kratos/kratos/v2/log"
+	kafkaGo "github.com/segmentio/kafka-go"
+)
 
 type Logger struct {
 }
@@ -15,3 +22,56 @@ type ErrorLogger struct {
 func (l ErrorLogger) Printf(msg string, args ...interface{}) {
 	log.Errorf(msg, args...)
 }
+
+// KratosLogger 将kafka-go的日志转发到Kratos的log.Logger，附带主题、分区等字段
+type KratosLogger struct {
+	logger log.Logger
+	level  log.Level
+	kvs    []interface{}
+}
+
+func NewKratosLogger(logger log.Logger, level log.Level) *KratosLogger {
+	return &KratosLogger{logger: logger, level: level}
+}
+
+func (l *KratosLogger) Printf(msg string, args ...interface{}) {
+	kvs := make([]interface{}, 0, len(l.kvs)+2)
+	kvs = append(kvs, l.kvs...)
+	kvs = append(kvs, log.DefaultMessageKey, fmt.Sprintf(msg, args...))
+	_ = l.logger.Log(l.level, kvs...)
+}
+
+// With 返回附带了额外字段的Logger
+func (l *KratosLogger) With(kvs ...interface{}) *KratosLogger {
+	return &KratosLogger{
+		logger: l.logger,
+		level:  l.level,
+		kvs:    append(append([]interface{}{}, l.kvs...), kvs...),
+	}
+}
+
+// joinedGroupFormat kafka-go v0.4.42加入消费组成功时输出的日志格式，参数依次是消费组、成员ID和代数。
+// kafka-go会分别以小写和大写开头输出两次，比较时忽略大小写。
+const joinedGroupFormat = "joined group %s as member %s in generation %d"
+
+// rebalanceLogger kafka-go的Reader没有提供消费组代数变化的回调，也没有公开当前的代数，
+// 这里从加入消费组的日志中获取代数，升级kafka-go时需要确认日志格式没有变化。
+type rebalanceLogger struct {
+	next       kafkaGo.Logger
+	handler    RebalanceHandler
+	generation int32
+}
+
+func (l *rebalanceLogger) Printf(msg string, args ...interface{}) {
+	if len(args) == 3 && strings.EqualFold(msg, joinedGroupFormat) {
+		if gen, ok := args[2].(int32); ok {
+			if old := atomic.SwapInt32(&l.generation, gen); old != gen {
+				l.handler(int(old), int(gen))
+			}
+		}
+	}
+
+	if l.next != nil {
+		l.next.Printf(msg, args...)
+	}
+}
@@ -0,0 +1,128 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semConv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+const (
+	meterName = "kratos-transport/kafka"
+
+	metricMessagesProduced = "messaging.kafka.messages.produced"
+	metricMessagesConsumed = "messaging.kafka.messages.consumed"
+	metricPublishErrors    = "messaging.kafka.publish.errors"
+	metricPublishDuration  = "messaging.kafka.publish.duration"
+	metricReconnects       = "messaging.kafka.reconnects"
+	metricPublishRetries   = "messaging.kafka.publish.retries"
+)
+
+// metrics OpenTelemetry指标，未设置MeterProvider时为nil，所有方法都可以在nil上调用。
+type metrics struct {
+	produced        metric.Int64Counter
+	consumed        metric.Int64Counter
+	publishErrors   metric.Int64Counter
+	publishDuration metric.Float64Histogram
+	reconnects      metric.Int64Counter
+	publishRetries  metric.Int64Counter
+}
+
+func newMetrics(provider metric.MeterProvider) (*metrics, error) {
+	meter := provider.Meter(meterName)
+
+	var err error
+	m := &metrics{}
+
+	if m.produced, err = meter.Int64Counter(metricMessagesProduced,
+		metric.WithDescription("Number of messages successfully produced"),
+	); err != nil {
+		return nil, err
+	}
+
+	if m.consumed, err = meter.Int64Counter(metricMessagesConsumed,
+		metric.WithDescription("Number of messages consumed"),
+	); err != nil {
+		return nil, err
+	}
+
+	if m.publishErrors, err = meter.Int64Counter(metricPublishErrors,
+		metric.WithDescription("Number of failed publishes"),
+	); err != nil {
+		return nil, err
+	}
+
+	if m.publishDuration, err = meter.Float64Histogram(metricPublishDuration,
+		metric.WithDescription("Duration of publishes"),
+		metric.WithUnit("ms"),
+	); err != nil {
+		return nil, err
+	}
+
+	if m.reconnects, err = meter.Int64Counter(metricReconnects,
+		metric.WithDescription("Number of readers and writers recreated after sustained failures"),
+	); err != nil {
+		return nil, err
+	}
+
+	if m.publishRetries, err = meter.Int64Counter(metricPublishRetries,
+		metric.WithDescription("Number of publish retries"),
+	); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func metricAttributes(topic string, partition int) metric.MeasurementOption {
+	attrs := []attribute.KeyValue{
+		semConv.MessagingSystemKey.String("kafka"),
+		semConv.MessagingDestinationKey.String(topic),
+	}
+	if partition >= 0 {
+		attrs = append(attrs, semConv.MessagingKafkaPartitionKey.Int(partition))
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+// recordPublish 记录一次发送，partition小于0表示分区未知。
+func (m *metrics) recordPublish(ctx context.Context, topic string, partition int, count int, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	attrs := metricAttributes(topic, partition)
+
+	m.publishDuration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), attrs)
+	if err != nil {
+		m.publishErrors.Add(ctx, 1, attrs)
+	} else {
+		m.produced.Add(ctx, int64(count), attrs)
+	}
+}
+
+func (m *metrics) recordConsume(ctx context.Context, topic string, partition int) {
+	if m == nil {
+		return
+	}
+
+	m.consumed.Add(ctx, 1, metricAttributes(topic, partition))
+}
+
+func (m *metrics) recordReconnect(ctx context.Context, topic string) {
+	if m == nil {
+		return
+	}
+
+	m.reconnects.Add(ctx, 1, metricAttributes(topic, -1))
+}
+
+func (m *metrics) recordRetry(ctx context.Context, topic string) {
+	if m == nil {
+		return
+	}
+
+	m.publishRetries.Add(ctx, 1, metricAttributes(topic, -1))
+}
@@ -1,12 +1,15 @@
 package kafka
 
 import (
+	"context"
 	"hash"
 	"time"
 
+	"github.com/go-kratos/kratos/v2/log"
 	kafkaGo "github.com/segmentio/kafka-go"
 	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/segmentio/kafka-go/sasl/scram"
+	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/tx7do/kratos-transport/broker"
 )
@@ -20,6 +23,19 @@ const (
 	Murmur2Balancer       = "Murmur2Balancer"
 )
 
+const (
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+	CompressionLz4    = "lz4"
+	CompressionZstd   = "zstd"
+)
+
+const (
+	RequiredAcksAll  = "all"
+	RequiredAcksOne  = "one"
+	RequiredAcksNone = "none"
+)
+
 ///
 /// Option
 ///
@@ -47,16 +63,76 @@ type loggerKey struct{}
 type errorLoggerKey struct{}
 type enableLoggerKey struct{}
 type enableErrorLoggerKey struct{}
+type kratosLoggerKey struct{}
 type enableOneTopicOneWriterKey struct{}
+type autoReconnectKey struct{}
+type writerStatsKey struct{}
+type writerStatsValue struct {
+	handler  WriterStatsHandler
+	interval time.Duration
+}
+
+type resolverKey struct{}
+type resolverValue struct {
+	resolver Resolver
+	interval time.Duration
+}
+
+// Resolver 通过服务发现等方式解析Kafka的地址
+type Resolver func(ctx context.Context) ([]string, error)
+
+type circuitBreakerValue struct {
+	failures int
+	cooldown time.Duration
+}
 
 type batchSizeKey struct{}
 type batchTimeoutKey struct{}
 type batchBytesKey struct{}
+type maxMessageBytesKey struct{}
+type compressionThresholdKey struct{}
 type asyncKey struct{}
 type maxAttemptsKey struct{}
 type readTimeoutKey struct{}
 type writeTimeoutKey struct{}
 type allowAutoTopicCreationKey struct{}
+type compressionKey struct{}
+type headerCodecKey struct{}
+type completionKey struct{}
+type keyFuncKey struct{}
+type circuitBreakerKey struct{}
+type correlationIDKeyKey struct{}
+type idempotentKey struct{}
+type requiredAcksKey struct{}
+type balancerInstanceKey struct{}
+type retryBackoffKey struct{}
+type errorHandlerKey struct{}
+type propagationKey struct{}
+type tlsFilesKey struct{}
+type tlsMinVersionKey struct{}
+type tlsCipherSuitesKey struct{}
+type saslScramKey struct{}
+type readerConfigFuncKey struct{}
+type readCommittedKey struct{}
+type writerConfigFuncKey struct{}
+type saslScramValue struct {
+	Algorithm string
+	Username  string
+	Password  string
+}
+type tlsFilesValue struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// KeyFunc 从消息体中提取消息键，返回错误时放弃发送。
+type KeyFunc func(msg broker.Any) ([]byte, error)
+
+// ErrorHandler 消息解码失败时调用，返回true提交该消息，返回false不提交该消息。
+// 注意：同一分区之后的消息提交时位点会越过这条消息，因此返回false只有在下一次提交之前消费者停止时，
+// 这条消息才会被重新消费。
+type ErrorHandler func(ctx context.Context, msg *broker.Message, err error) bool
 
 // WithReaderConfig .
 func WithReaderConfig(cfg kafkaGo.ReaderConfig) broker.Option {
@@ -68,11 +144,33 @@ func WithWriterConfig(cfg WriterConfig) broker.Option {
 	return broker.OptionContextWithValue(writerConfigKey{}, cfg)
 }
 
+// WithReadCommitted 只读取已提交的事务消息，中止的事务消息不会投递给订阅者
+func WithReadCommitted() broker.Option {
+	return broker.OptionContextWithValue(readCommittedKey{}, true)
+}
+
+// WithReaderConfigFunc 订阅时在创建Reader之前修改Reader的配置，用于设置没有提供选项的参数
+func WithReaderConfigFunc(fn func(cfg *kafkaGo.ReaderConfig)) broker.Option {
+	return broker.OptionContextWithValue(readerConfigFuncKey{}, fn)
+}
+
+// WithWriterConfigFunc 在Init的最后修改Writer的配置，用于设置没有提供选项的参数
+func WithWriterConfigFunc(fn func(cfg *WriterConfig)) broker.Option {
+	return broker.OptionContextWithValue(writerConfigFuncKey{}, fn)
+}
+
 // WithEnableOneTopicOneWriter .
 func WithEnableOneTopicOneWriter(enable bool) broker.Option {
 	return broker.OptionContextWithValue(enableOneTopicOneWriterKey{}, enable)
 }
 
+// WithSharedWriter 所有主题共用一个Writer，消息的主题由每条消息自身的Topic决定。
+//
+// 适用于向大量低流量主题发送消息的场景，可以减少连接数，kafka-go内部仍然会按主题分批发送。
+func WithSharedWriter() broker.Option {
+	return WithEnableOneTopicOneWriter(false)
+}
+
 // WithDialer .
 func WithDialer(cfg *kafkaGo.Dialer) broker.Option {
 	return broker.OptionContextWithValue(dialerConfigKey{}, cfg)
@@ -96,6 +194,20 @@ func WithScramMechanism(algo scram.Algorithm, username, password string) broker.
 	return broker.OptionContextWithValue(mechanismKey{}, mechanism)
 }
 
+// WithSASLPlain PLAIN认证，同时用于消费者和生产者
+func WithSASLPlain(username, password string) broker.Option {
+	return WithPlainMechanism(username, password)
+}
+
+// WithSASLScram SCRAM认证，同时用于消费者和生产者，algo支持sha256和sha512
+func WithSASLScram(username, password, algo string) broker.Option {
+	return broker.OptionContextWithValue(saslScramKey{}, &saslScramValue{
+		Algorithm: algo,
+		Username:  username,
+		Password:  password,
+	})
+}
+
 // WithDialerTimeout .
 func WithDialerTimeout(tm time.Duration) broker.Option {
 	return broker.OptionContextWithValue(dialerTimeoutKey{}, tm)
@@ -106,6 +218,19 @@ func WithRetries(cnt int) broker.Option {
 	return broker.OptionContextWithValue(retriesCountKey{}, cnt)
 }
 
+// WithRetryBackoff 发送失败重试时的指数退避策略，每次重试等待的时间在退避时间的[1/2, 1)之间随机取值。
+//
+// default：initial 200ms，max 5s，factor 2
+func WithRetryBackoff(initial, max time.Duration, factor float64) broker.Option {
+	return broker.OptionContextWithValue(retryBackoffKey{},
+		retryBackoff{
+			Initial: initial,
+			Max:     max,
+			Factor:  factor,
+		},
+	)
+}
+
 // WithQueueCapacity .
 func WithQueueCapacity(cap int) broker.Option {
 	return broker.OptionContextWithValue(queueCapacityKey{}, cap)
@@ -136,11 +261,28 @@ func WithHeartbeatInterval(interval time.Duration) broker.Option {
 	return broker.OptionContextWithValue(heartbeatIntervalKey{}, interval)
 }
 
-// WithCommitInterval .
+// WithCommitInterval 提交位点的间隔，为0时同步提交，建议使用WithSyncCommit或WithAsyncCommit。
 func WithCommitInterval(interval time.Duration) broker.Option {
 	return broker.OptionContextWithValue(commitIntervalKey{}, interval)
 }
 
+// WithSyncCommit 同步提交位点，Ack在位点提交到Kafka之后才返回，返回的错误表示提交失败。
+// 和WithAsyncCommit、WithCommitInterval设置的是同一个配置，以最后设置的为准。
+//
+// default：同步提交
+func WithSyncCommit() broker.Option {
+	return broker.OptionContextWithValue(commitIntervalKey{}, time.Duration(0))
+}
+
+// WithAsyncCommit 每隔interval批量提交一次位点，Ack只记录位点并立即返回，吞吐量更高，
+// 但是进程退出前没有提交的位点会丢失，这些消息会被重复消费。interval小于等于0时为1秒。
+func WithAsyncCommit(interval time.Duration) broker.Option {
+	if interval <= 0 {
+		interval = defaultCommitInterval
+	}
+	return broker.OptionContextWithValue(commitIntervalKey{}, interval)
+}
+
 // WithPartitionWatchInterval .
 func WithPartitionWatchInterval(interval time.Duration) broker.Option {
 	return broker.OptionContextWithValue(partitionWatchIntervalKey{}, interval)
@@ -196,6 +338,13 @@ func WithEnableErrorLogger(enable bool) broker.Option {
 	return broker.OptionContextWithValue(enableErrorLoggerKey{}, enable)
 }
 
+// WithKratosLogger 将kafka-go的日志输出到Kratos的logger，普通日志为Debug级别，错误日志为Error级别，
+// Reader的日志附带topic字段（指定分区消费时还有partition字段），一个主题一个Writer时Writer的日志附带topic字段。
+// 优先于WithLogger、WithEnableLogger等选项。
+func WithKratosLogger(logger log.Logger) broker.Option {
+	return broker.OptionContextWithValue(kratosLoggerKey{}, logger)
+}
+
 // WithBatchSize 发送批次大小 batch.size
 //
 //	default：100
@@ -217,6 +366,14 @@ func WithBatchBytes(by int64) broker.Option {
 	return broker.OptionContextWithValue(batchBytesKey{}, by)
 }
 
+// WithMaxMessageBytes 序列化后的消息体超过n字节时直接返回ErrMessageTooLarge，不再尝试写入。
+// 通常设置为主题的max.message.bytes。
+//
+// default：0，不限制
+func WithMaxMessageBytes(n int) broker.Option {
+	return broker.OptionContextWithValue(maxMessageBytesKey{}, n)
+}
+
 // WithAsync 异步发送消息
 //
 // default：true
@@ -224,6 +381,27 @@ func WithAsync(enable bool) broker.Option {
 	return broker.OptionContextWithValue(asyncKey{}, enable)
 }
 
+// WithRequiredAcks 写入需要的确认级别，可选all、one、none。
+// 设置为all并且同步发送时，Publish返回nil表示leader和所有同步副本都已经写入。
+//
+// default：kafka-go的默认值，即RequireNone
+func WithRequiredAcks(acks string) broker.Option {
+	return broker.OptionContextWithValue(requiredAcksKey{}, acks)
+}
+
+// WithIdempotent 幂等发送，RequiredAcks设置为RequireAll并且关闭异步发送。
+//
+// 开启后，发送超时等无法确定消息是否已写入的错误不会触发重发，以免产生重复消息。
+// 不能与WithAsync(true)一起使用。
+func WithIdempotent() broker.Option {
+	return broker.OptionContextWithValue(idempotentKey{}, true)
+}
+
+// WithBalancerInstance 自定义负载均衡器，优先于WithHashBalancer等预置的均衡器。
+func WithBalancerInstance(balancer kafkaGo.Balancer) broker.Option {
+	return broker.OptionContextWithValue(balancerInstanceKey{}, balancer)
+}
+
 // WithPublishMaxAttempts .
 func WithPublishMaxAttempts(cnt int) broker.Option {
 	return broker.OptionContextWithValue(maxAttemptsKey{}, cnt)
@@ -248,6 +426,101 @@ func WithAllowAutoTopicCreation(enable bool) broker.Option {
 	return broker.OptionContextWithValue(allowAutoTopicCreationKey{}, enable)
 }
 
+// WithCompression 消息压缩算法，支持：gzip、snappy、lz4、zstd，不支持的算法会导致Init返回错误。
+//
+// default：不压缩
+func WithCompression(codec string) broker.Option {
+	return broker.OptionContextWithValue(compressionKey{}, codec)
+}
+
+// WithCompressionThreshold 只压缩消息体超过n字节的消息，不超过的使用另外一组不压缩的Writer发送，
+// 避免压缩小消息浪费CPU。批量发送时按整批消息体的大小判断。需要同时设置WithCompression。
+//
+// 注意：每个主题最多会有两个Writer，WithWriterStatsHandler会分别回调两个Writer的统计信息。
+//
+// default：0，压缩所有消息
+func WithCompressionThreshold(n int) broker.Option {
+	return broker.OptionContextWithValue(compressionThresholdKey{}, n)
+}
+
+// WithHeaderCodec 消息头中非字符串的值使用该编解码器编码，默认使用gob，订阅时通过Event.Header解码
+func WithHeaderCodec(codec string) broker.Option {
+	return broker.OptionContextWithValue(headerCodecKey{}, codec)
+}
+
+// WithCompletionHandler 消息投递完成（成功或者失败）时的回调，异步发送时可以通过它获取投递错误，
+// 每条消息的写入次数可以通过MessageAttempts获取。
+func WithCompletionHandler(handler func(messages []kafkaGo.Message, err error)) broker.Option {
+	return broker.OptionContextWithValue(completionKey{}, handler)
+}
+
+// WithKeyFunc 在序列化之前从消息体中提取消息键，使相关的消息落在同一个分区上以保证顺序。
+func WithKeyFunc(fn KeyFunc) broker.Option {
+	return broker.OptionContextWithValue(keyFuncKey{}, fn)
+}
+
+// WithCorrelationIDKey 发送时从发送上下文中读取key对应的关联ID（字符串），写入x-correlation-id消息头；
+// 消费时把消息头中的关联ID以同样的key放回处理函数的上下文。
+func WithCorrelationIDKey(key interface{}) broker.Option {
+	return broker.OptionContextWithValue(correlationIDKeyKey{}, key)
+}
+
+// WithCircuitBreaker 连续failures次发送失败之后打开熔断器，cooldown时间内的发送直接返回ErrCircuitOpen，
+// 冷却时间结束后放行一次探测发送，成功后恢复正常。熔断器的状态可以通过CircuitState获取。
+func WithCircuitBreaker(failures int, cooldown time.Duration) broker.Option {
+	return broker.OptionContextWithValue(circuitBreakerKey{}, &circuitBreakerValue{failures: failures, cooldown: cooldown})
+}
+
+// WithErrorHandler 设置消息解码失败时的处理函数，设置后解码失败的消息不再交给订阅者处理。
+func WithErrorHandler(handler ErrorHandler) broker.Option {
+	return broker.OptionContextWithValue(errorHandlerKey{}, handler)
+}
+
+// WithPropagation 通过消息头传递上下文（如W3C traceparent、baggage），即使没有配置链路追踪也会生效。
+func WithPropagation(propagator propagation.TextMapPropagator) broker.Option {
+	return broker.OptionContextWithValue(propagationKey{}, propagator)
+}
+
+// WithTLSFiles 在Init时从文件加载TLS配置，同时用于消费者和生产者。
+// caFile为空时使用系统根证书，certFile和keyFile为空时不使用客户端证书。
+func WithTLSFiles(caFile, certFile, keyFile string) broker.Option {
+	return broker.OptionContextWithValue(tlsFilesKey{}, &tlsFilesValue{
+		CAFile:   caFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+}
+
+// WithTLSMinVersion TLS的最低版本，例如tls.VersionTLS12，在WithTLSFiles或者broker.WithTLSConfig的配置上生效。
+func WithTLSMinVersion(version uint16) broker.Option {
+	return broker.OptionContextWithValue(tlsMinVersionKey{}, version)
+}
+
+// WithTLSCipherSuites 允许使用的加密套件，TLS 1.3的加密套件不可配置，最低版本为TLS 1.3时不能设置。
+func WithTLSCipherSuites(suites []uint16) broker.Option {
+	return broker.OptionContextWithValue(tlsCipherSuitesKey{}, append([]uint16{}, suites...))
+}
+
+// WithAutoReconnect 连接持续失败时自动重建Reader和Writer，不需要重启服务
+func WithAutoReconnect(enable bool) broker.Option {
+	return broker.OptionContextWithValue(autoReconnectKey{}, enable)
+}
+
+// WithResolver Connect时调用resolver解析Kafka的地址，代替WithAddress设置的地址，之后每隔interval重新解析一次，
+// 集群扩容后不需要重启。新的地址只对之后创建的Reader和Writer生效，解析失败时继续使用原来的地址。
+//
+// default：interval小于等于0时为1分钟
+func WithResolver(resolver Resolver, interval time.Duration) broker.Option {
+	return broker.OptionContextWithValue(resolverKey{}, &resolverValue{resolver: resolver, interval: interval})
+}
+
+// WithWriterStatsHandler 每隔interval回调一次各个Writer的统计信息，可用于观察批量发送的效率。
+//
+// 注意：kafka-go的Writer.Stats()返回的是上次调用之后的增量，和WriterStats共用同一份计数。
+func WithWriterStatsHandler(handler WriterStatsHandler, interval time.Duration) broker.Option {
+	return broker.OptionContextWithValue(writerStatsKey{}, &writerStatsValue{handler: handler, interval: interval})
+}
+
 ///
 /// PublishOption
 ///
@@ -255,6 +528,12 @@ func WithAllowAutoTopicCreation(enable bool) broker.Option {
 type messageHeadersKey struct{}
 type messageKeyKey struct{}
 type messageOffsetKey struct{}
+type messagePartitionKey struct{}
+type messageTimeKey struct{}
+type syncPublishKey struct{}
+type batchMessageKeysKey struct{}
+type batchHeadersKey struct{}
+type publishTimeoutKey struct{}
 type balancerKey struct{}
 type balancerValue struct {
 	Name       string
@@ -277,6 +556,40 @@ func WithMessageOffset(offset int64) broker.PublishOption {
 	return broker.PublishContextWithValue(messageOffsetKey{}, offset)
 }
 
+// WithMessageTime 设置消息的时间戳，例如导入历史数据时保留原始的事件时间。
+// 只有主题的message.timestamp.type为CreateTime（默认值）时才会使用该时间，LogAppendTime时会被broker覆盖。
+//
+// default：发送时的时间
+func WithMessageTime(t time.Time) broker.PublishOption {
+	return broker.PublishContextWithValue(messageTimeKey{}, t)
+}
+
+// WithPartition 将消息写入指定的分区，绕过负载均衡器，不能和按键哈希的均衡器同时使用。
+// 分区不存在时记录日志并回退到负载均衡器。
+func WithPartition(partition int) broker.PublishOption {
+	return broker.PublishContextWithValue(messagePartitionKey{}, partition)
+}
+
+// WithSyncPublish 同步发送消息，阻塞直到Kafka按照RequiredAcks确认写入。
+func WithSyncPublish() broker.PublishOption {
+	return broker.PublishContextWithValue(syncPublishKey{}, true)
+}
+
+// WithBatchMessageKeys 批量发送时每条消息的键，按下标对应PublishBatch的消息。
+func WithBatchMessageKeys(keys [][]byte) broker.PublishOption {
+	return broker.PublishContextWithValue(batchMessageKeysKey{}, keys)
+}
+
+// WithBatchHeaders 批量发送时每条消息的消息头，按下标对应PublishBatch的消息。
+func WithBatchHeaders(headers []map[string]interface{}) broker.PublishOption {
+	return broker.PublishContextWithValue(batchHeadersKey{}, headers)
+}
+
+// WithPublishTimeout 发送消息的超时时间，超时返回ErrPublishTimeout。
+func WithPublishTimeout(timeout time.Duration) broker.PublishOption {
+	return broker.PublishContextWithValue(publishTimeoutKey{}, timeout)
+}
+
 // WithLeastBytesBalancer LeastBytes负载均衡器
 func WithLeastBytesBalancer() broker.PublishOption {
 	return broker.PublishContextWithValue(balancerKey{},
@@ -338,3 +651,138 @@ func WithMurmur2Balancer(consistent bool) broker.PublishOption {
 ///
 /// SubscribeOption
 ///
+
+type gracefulTimeoutKey struct{}
+type statsHandlerKey struct{}
+type statsIntervalKey struct{}
+type deadLetterKey struct{}
+type startTimeKey struct{}
+type startTimeIfUncommittedKey struct{}
+type partitionOffsetKey struct{}
+type concurrencyKey struct{}
+type batchConsumeKey struct{}
+type batchHandlerKey struct{}
+type rebalanceHandlerKey struct{}
+type handlerTimeoutKey struct{}
+type commitRetriesKey struct{}
+type subscribeStartOffsetKey struct{}
+type startPausedKey struct{}
+type healthStalenessKey struct{}
+type deadLetterValue struct {
+	Topic      string
+	MaxRetries int
+}
+type batchConsumeValue struct {
+	MaxRecords int
+	MaxWait    time.Duration
+}
+
+// WithGracefulTimeout 取消订阅时等待正在处理的消息完成的最长时间，超时后强制关闭Reader。
+// timeout小于等于0时一直等待直到处理完成，此时不能在处理函数中同步调用Unsubscribe，否则会死锁。
+//
+// default：30s。在处理函数中同步调用Unsubscribe时，会等待到超时后才返回，建议使用go sub.Unsubscribe()。
+func WithGracefulTimeout(timeout time.Duration) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(gracefulTimeoutKey{}, timeout)
+}
+
+// WithHandlerTimeout 每条消息的处理函数使用超时时间为timeout的上下文，超时后不再等待处理函数返回，继续处理下一条消息，
+// 超时的消息不会提交。处理函数应当在上下文结束后尽快返回。
+//
+// default：0，不限制
+func WithHandlerTimeout(timeout time.Duration) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(handlerTimeoutKey{}, timeout)
+}
+
+// WithCommitRetries 提交位点失败时最多重试n次，重试间隔使用WithRetryBackoff设置的退避策略，对Ack和自动确认都生效。
+//
+// default：0，不重试
+func WithCommitRetries(n int) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(commitRetriesKey{}, n)
+}
+
+// WithHealthStaleness 还有积压的消息时，超过d没有拉取到消息则Health报告订阅停滞、不健康。
+// d小于等于0时不检查停滞。
+//
+// default：5分钟
+func WithHealthStaleness(d time.Duration) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(healthStalenessKey{}, d)
+}
+
+// WithStatsHandler 定期回调Reader的统计信息，可用于采集消费延迟等指标。
+func WithStatsHandler(handler StatsHandler) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(statsHandlerKey{}, handler)
+}
+
+// WithStatsInterval 统计信息的回调间隔
+//
+// default：ReadLagInterval，未设置则为1分钟
+func WithStatsInterval(interval time.Duration) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(statsIntervalKey{}, interval)
+}
+
+// WithDeadLetter 消息处理失败maxRetries次之后，将原消息连同键和消息头转发到死信主题topic。
+// 死信消息同步写入，写入失败时按WithRetryBackoff的退避策略一直重试，期间不处理该分区之后的消息；
+// 取消订阅时放弃重试，原消息不提交，之后重新消费。
+func WithDeadLetter(topic string, maxRetries int) broker.SubscribeOption {
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	return broker.SubscribeContextWithValue(deadLetterKey{},
+		&deadLetterValue{
+			Topic:      topic,
+			MaxRetries: maxRetries,
+		},
+	)
+}
+
+// WithStartTime 从时间t之后的第一条消息开始消费。
+// 订阅前会覆盖该消费组已提交的位点，因此消费组中不能有其他活跃的成员。
+// 注意：每次订阅（包括服务重启）都会重新覆盖位点并从t开始消费，回放完成后需要去掉该选项，
+// 或者同时使用WithStartTimeIfUncommitted。
+func WithStartTime(t time.Time) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(startTimeKey{}, t)
+}
+
+// WithStartTimeIfUncommitted 与WithStartTime一起使用，只在消费组还没有提交过位点时从t开始消费，
+// 之后重启从已提交的位点继续消费。
+func WithStartTimeIfUncommitted() broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(startTimeIfUncommittedKey{}, true)
+}
+
+// WithSubscribeStartOffset 新的消费组没有已提交的位点时从哪里开始消费，覆盖WithStartOffset的全局设置，
+// 取值为kafkaGo.FirstOffset或kafkaGo.LastOffset。
+func WithSubscribeStartOffset(offset int64) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(subscribeStartOffsetKey{}, offset)
+}
+
+// WithStartPaused 订阅后处于暂停状态，调用Resume之后才开始处理消息，例如等待缓存预热完成
+func WithStartPaused() broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(startPausedKey{}, true)
+}
+
+// WithConcurrency 使用n个协程并发处理消息，同一分区的消息仍然按顺序处理。
+//
+// default：1
+func WithConcurrency(n int) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(concurrencyKey{}, n)
+}
+
+// WithRebalanceHandler 消费组重新平衡、代数变化时回调handler，handler在kafka-go的协程中同步调用，不能阻塞。
+// 不使用消费组的订阅不会回调。
+// 注意：kafka-go没有公开消费组的代数，代数是从kafka-go v0.4.42加入消费组时输出的日志中解析的，
+// 升级kafka-go后日志格式变化会导致不再回调。
+func WithRebalanceHandler(handler RebalanceHandler) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(rebalanceHandlerKey{}, handler)
+}
+
+// WithBatchConsume SubscribeBatch每次最多攒maxRecords条消息，或者从收到第一条消息起等待maxWait之后，交给批量处理函数。
+//
+// default：maxRecords 100，maxWait 1s
+func WithBatchConsume(maxRecords int, maxWait time.Duration) broker.SubscribeOption {
+	return broker.SubscribeContextWithValue(batchConsumeKey{},
+		&batchConsumeValue{
+			MaxRecords: maxRecords,
+			MaxWait:    maxWait,
+		},
+	)
+}
@@ -2,12 +2,49 @@ package kafka
 
 import (
 	"context"
+	"time"
 
+	"github.com/go-kratos/kratos/v2/encoding"
 	kafkaGo "github.com/segmentio/kafka-go"
 
 	"github.com/tx7do/kratos-transport/broker"
 )
 
+// Event 在broker.Event的基础上扩展了Kafka专有的方法，可以在处理函数中通过类型断言获取。
+type Event interface {
+	broker.Event
+
+	// RawMessage 返回原始的kafka-go消息
+	RawMessage() kafkaGo.Message
+
+	// Nack 不确认该消息，处理函数返回后按WithRetryBackoff的退避策略等待，然后重新投递。
+	// 设置了WithDeadLetter时最多投递maxRetries次，否则最多重新投递10次，之后按处理完成对待。
+	Nack() error
+
+	// CommitMessages 批量提交消息的偏移量，用于关闭自动确认后自行控制提交节奏。
+	CommitMessages(ctx context.Context, msgs ...kafkaGo.Message) error
+
+	// Partition 消息所在的分区
+	Partition() int
+
+	// Offset 消息在分区中的偏移量
+	Offset() int64
+
+	// Key 消息键
+	Key() []byte
+
+	// TypedKey 使用broker.WithKeyBinder订阅时，解码之后的消息键
+	TypedKey() broker.Any
+
+	// Timestamp 消息写入的时间
+	Timestamp() time.Time
+
+	// Header 将消息头key的值解码到out中，编解码器由WithHeaderCodec指定
+	Header(key string, out interface{}) error
+}
+
+var _ Event = (*publication)(nil)
+
 type publication struct {
 	topic  string
 	err    error
@@ -15,6 +52,13 @@ type publication struct {
 	ctx    context.Context
 	reader *kafkaGo.Reader
 	km     kafkaGo.Message
+	nacked bool
+
+	typedKey    broker.Any
+	headerCodec encoding.Codec
+
+	commitRetries int
+	commitBackoff retryBackoff
 }
 
 func (p *publication) Topic() string {
@@ -25,8 +69,51 @@ func (p *publication) Message() *broker.Message {
 	return p.m
 }
 
+// Ack 提交消息的位点，使用WithAsyncCommit时只记录位点，由后台定期提交
 func (p *publication) Ack() error {
-	return p.reader.CommitMessages(p.ctx, p.km)
+	return commitWithRetry(p.ctx, p.reader.CommitMessages, p.commitRetries, p.commitBackoff, p.km)
+}
+
+func (p *publication) Nack() error {
+	p.nacked = true
+	return nil
+}
+
+func (p *publication) TypedKey() broker.Any {
+	return p.typedKey
+}
+
+func (p *publication) RawMessage() kafkaGo.Message {
+	return p.km
+}
+
+func (p *publication) Partition() int {
+	return p.km.Partition
+}
+
+func (p *publication) Offset() int64 {
+	return p.km.Offset
+}
+
+func (p *publication) Key() []byte {
+	return p.km.Key
+}
+
+func (p *publication) Timestamp() time.Time {
+	return p.km.Time
+}
+
+func (p *publication) Header(key string, out interface{}) error {
+	for _, h := range p.km.Headers {
+		if h.Key == key {
+			return decodeHeaderValue(p.headerCodec, h.Value, out)
+		}
+	}
+	return ErrHeaderNotFound
+}
+
+func (p *publication) CommitMessages(ctx context.Context, msgs ...kafkaGo.Message) error {
+	return commitWithRetry(ctx, p.reader.CommitMessages, p.commitRetries, p.commitBackoff, msgs...)
 }
 
 func (p *publication) Error() error {
@@ -1,22 +1,135 @@
 package kafka
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
 
 	kafkaGo "github.com/segmentio/kafka-go"
 
 	"github.com/tx7do/kratos-transport/broker"
 )
 
+// BatchHandler 批量处理消息，返回错误时不提交该批次
+type BatchHandler func(ctx context.Context, msgs []*broker.Message) error
+
+// RebalanceHandler 消费组的代数变化时回调，oldGen为0表示第一次加入消费组
+type RebalanceHandler func(oldGen, newGen int)
+
+// StatsHandler 定期接收Reader的统计信息
+type StatsHandler func(stats kafkaGo.ReaderStats)
+
+// TypedHandler 处理已经解码为*T的消息体
+type TypedHandler[T any] func(ctx context.Context, msg *T) error
+
+// SubscribeTyped 订阅topic，自动设置binder并把消息体解码为*T交给handler
+func SubscribeTyped[T any](b broker.Broker, topic string, handler TypedHandler[T], opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	return b.Subscribe(topic,
+		func(ctx context.Context, event broker.Event) error {
+			switch t := event.Message().Body.(type) {
+			case *T:
+				return handler(ctx, t)
+			default:
+				return fmt.Errorf("unsupported type: %T", t)
+			}
+		},
+		func() broker.Any {
+			return new(T)
+		},
+		opts...,
+	)
+}
+
+// Subscriber 在broker.Subscriber的基础上扩展了Kafka专有的方法，可以通过类型断言获取。
+type Subscriber interface {
+	broker.Subscriber
+
+	// Lag 返回最近一次拉取的消息与分区最高水位之间的差值
+	Lag() int64
+
+	// Pause 暂停拉取消息，不退出消费组
+	Pause()
+
+	// Resume 恢复拉取消息，从最后一条未提交的消息继续消费
+	Resume()
+
+	// Health 返回订阅的健康状态，可用于就绪探针
+	Health() SubscriberHealth
+}
+
+// SubscriberHealth 订阅的健康状态
+type SubscriberHealth struct {
+	// Healthy 订阅没有关闭，最近一次拉取没有失败，并且没有停滞：还有积压的消息（Lag大于0）时，
+	// 超过WithHealthStaleness设置的时间没有拉取到消息视为停滞，例如一直在重新平衡。
+	// 主题没有新消息时拉取会一直等待，不影响健康状态；暂停时不检查停滞。
+	Healthy bool
+
+	// Stale 还有积压的消息，但是超过WithHealthStaleness设置的时间没有拉取到消息
+	Stale bool
+
+	// LastFetch 最近一次成功拉取到消息的时间，还没有拉取到消息时为零值
+	LastFetch time.Time
+
+	// LastError 最近一次拉取失败的错误，之后拉取成功时清空
+	LastError error
+
+	// Failures 连续拉取失败的次数
+	Failures int
+
+	Lag    int64
+	Paused bool
+}
+
+var _ Subscriber = (*subscriber)(nil)
+
+// SubscriptionInfo 当前活跃订阅的概要信息
+type SubscriptionInfo struct {
+	Topic     string
+	Group     string
+	StartedAt time.Time
+}
+
 type subscriber struct {
 	k       *kafkaBroker
 	topic   string
 	opts    broker.SubscribeOptions
 	handler broker.Handler
-	reader  *kafkaGo.Reader
+	binder  broker.Binder
 	closed  bool
 	done    chan struct{}
 	sync.RWMutex
+
+	ctx             context.Context
+	cancel          context.CancelFunc
+	gracefulTimeout time.Duration
+	handlerTimeout  time.Duration
+	commitRetries   int
+	healthStaleness time.Duration
+
+	// 自动重连时Reader会被替换
+	readerMu     sync.RWMutex
+	reader       *kafkaGo.Reader
+	readerConfig kafkaGo.ReaderConfig
+	readerClosed bool
+	next         int64
+
+	lag int64
+
+	healthMu  sync.Mutex
+	lastFetch time.Time
+	lastErr   error
+	failures  int
+
+	deadLetter *deadLetterValue
+	dedup      *broker.Dedup
+
+	resume chan struct{}
+
+	startedAt time.Time
 }
 
 func (s *subscriber) Options() broker.SubscribeOptions {
@@ -27,10 +140,229 @@ func (s *subscriber) Topic() string {
 	return s.topic
 }
 
+// Unsubscribe 取消订阅，等待正在处理的消息完成之后关闭Reader，最长等待WithGracefulTimeout设置的时间。
+// 在处理函数中同步调用时，要等处理函数返回才能完成，因此会一直等待到超时。
 func (s *subscriber) Unsubscribe() error {
-	var err error
+	if !s.stop() {
+		return nil
+	}
+
+	// 等待正在处理的消息完成，超时则强制关闭
+	if s.done != nil {
+		if s.gracefulTimeout > 0 {
+			select {
+			case <-s.done:
+			case <-time.After(s.gracefulTimeout):
+				log.Warnf("[kafka]: subscriber [%s] drain timeout, force close", s.topic)
+			}
+		} else {
+			<-s.done
+		}
+	}
+
+	return s.closeReader()
+}
+
+// stop 标记订阅已关闭并取消拉取，已关闭时返回false
+func (s *subscriber) stop() bool {
 	s.Lock()
-	defer s.Unlock()
+	if s.closed {
+		s.Unlock()
+		return false
+	}
 	s.closed = true
-	return err
+	s.Unlock()
+
+	if s.k != nil {
+		s.k.removeSubscriber(s)
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return true
+}
+
+// context 返回订阅的上下文，取消订阅时结束
+func (s *subscriber) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// handle 调用处理函数，设置了WithHandlerTimeout时每条消息使用单独的超时上下文，超时后不再等待处理函数返回
+func (s *subscriber) handle(ctx context.Context, event broker.Event) error {
+	if s.handlerTimeout <= 0 {
+		return s.handler(ctx, event)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.handlerTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handler(ctx, event)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w after %s", ErrHandlerTimeout, s.handlerTimeout)
+	}
+}
+
+func (s *subscriber) info() SubscriptionInfo {
+	return SubscriptionInfo{
+		Topic:     s.topic,
+		Group:     s.opts.Queue,
+		StartedAt: s.startedAt,
+	}
+}
+
+func (s *subscriber) Lag() int64 {
+	return atomic.LoadInt64(&s.lag)
+}
+
+func (s *subscriber) Pause() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.resume == nil {
+		s.resume = make(chan struct{})
+	}
+}
+
+func (s *subscriber) Resume() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.resume != nil {
+		close(s.resume)
+		s.resume = nil
+	}
+}
+
+// waitResume 暂停时阻塞直到恢复，ctx结束时返回false
+func (s *subscriber) waitResume(ctx context.Context) bool {
+	s.RLock()
+	resume := s.resume
+	s.RUnlock()
+
+	if resume == nil {
+		return true
+	}
+
+	select {
+	case <-resume:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *subscriber) Health() SubscriberHealth {
+	s.RLock()
+	closed := s.closed
+	paused := s.resume != nil
+	s.RUnlock()
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	lag := s.Lag()
+
+	var stale bool
+	if !paused && s.healthStaleness > 0 && lag > 0 {
+		last := s.lastFetch
+		if last.IsZero() {
+			last = s.startedAt
+		}
+		stale = time.Since(last) > s.healthStaleness
+	}
+
+	return SubscriberHealth{
+		Healthy:   !closed && s.lastErr == nil && !stale,
+		Stale:     stale,
+		LastFetch: s.lastFetch,
+		LastError: s.lastErr,
+		Failures:  s.failures,
+		Lag:       lag,
+		Paused:    paused,
+	}
+}
+
+// recordFetch 记录拉取的结果，用于Health
+func (s *subscriber) recordFetch(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	if err != nil {
+		s.lastErr = err
+		s.failures++
+		return
+	}
+	s.lastFetch = time.Now()
+	s.lastErr = nil
+	s.failures = 0
+}
+
+func (s *subscriber) updateLag(msg kafkaGo.Message) {
+	if msg.HighWaterMark <= 0 {
+		return
+	}
+	lag := msg.HighWaterMark - msg.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	atomic.StoreInt64(&s.lag, lag)
+}
+
+func (s *subscriber) runStats(ctx context.Context, interval time.Duration, handler StatsHandler) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			handler(s.getReader().Stats())
+		}
+	}
+}
+
+func (s *subscriber) getReader() *kafkaGo.Reader {
+	s.readerMu.RLock()
+	defer s.readerMu.RUnlock()
+
+	return s.reader
+}
+
+// replaceReader 替换Reader并关闭旧的Reader，订阅已关闭时返回false
+func (s *subscriber) replaceReader(reader *kafkaGo.Reader) bool {
+	s.readerMu.Lock()
+	if s.readerClosed {
+		s.readerMu.Unlock()
+		_ = reader.Close()
+		return false
+	}
+	old := s.reader
+	s.reader = reader
+	s.readerMu.Unlock()
+
+	_ = old.Close()
+	return true
+}
+
+func (s *subscriber) closeReader() error {
+	s.readerMu.Lock()
+	defer s.readerMu.Unlock()
+
+	if s.readerClosed {
+		return nil
+	}
+	s.readerClosed = true
+	return s.reader.Close()
 }
@@ -1,7 +1,28 @@
 package kafka
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/encoding"
+	"github.com/go-kratos/kratos/v2/log"
 	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/scram"
 
 	"github.com/tx7do/kratos-transport/broker"
 )
@@ -13,3 +34,319 @@ func kafkaHeaderToMap(h []kafkaGo.Header) broker.Headers {
 	}
 	return m
 }
+
+// hasHeader 判断消息头中是否已经存在key
+func hasHeader(headers []kafkaGo.Header, key string) bool {
+	for _, h := range headers {
+		if h.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mapToKafkaHeader 字符串和字节切片原样写入，其它类型使用codec编码，codec为nil时使用gob
+func mapToKafkaHeader(codec encoding.Codec, headers map[string]interface{}) []kafkaGo.Header {
+	var out []kafkaGo.Header
+	for k, v := range headers {
+		header := kafkaGo.Header{Key: k}
+		switch t := v.(type) {
+		case string:
+			header.Value = []byte(t)
+		case []byte:
+			header.Value = t
+		default:
+			buf, err := encodeHeaderValue(codec, v)
+			if err != nil {
+				continue
+			}
+			header.Value = buf
+		}
+		out = append(out, header)
+	}
+	return out
+}
+
+func encodeHeaderValue(codec encoding.Codec, v interface{}) ([]byte, error) {
+	if codec != nil {
+		return codec.Marshal(v)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeHeaderValue(codec encoding.Codec, data []byte, out interface{}) error {
+	if codec != nil {
+		return codec.Unmarshal(data, out)
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(out)
+}
+
+// waitContext 等待一段时间，如果上下文先结束则返回上下文的错误。
+func waitContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// commitWithRetry 提交失败时按退避策略最多重试retries次
+func commitWithRetry(ctx context.Context, commit func(context.Context, ...kafkaGo.Message) error, retries int, backoff retryBackoff, msgs ...kafkaGo.Message) error {
+	err := commit(ctx, msgs...)
+	for i := 0; err != nil && i < retries; i++ {
+		if waitContext(ctx, backoff.duration(i)) != nil {
+			break
+		}
+		err = commit(ctx, msgs...)
+	}
+	return err
+}
+
+// parseCompression kafka-go内置了gzip、snappy、lz4、zstd四种编解码器，消费时按消息批次的属性自动解压，
+// 不需要额外导入或注册。
+func parseCompression(codec string) (kafkaGo.Compression, error) {
+	switch codec {
+	case CompressionGzip:
+		return kafkaGo.Gzip, nil
+	case CompressionSnappy:
+		return kafkaGo.Snappy, nil
+	case CompressionLz4:
+		return kafkaGo.Lz4, nil
+	case CompressionZstd:
+		return kafkaGo.Zstd, nil
+	default:
+		return 0, fmt.Errorf("kafka: unsupported compression codec [%s]", codec)
+	}
+}
+
+func parseRequiredAcks(acks string) (kafkaGo.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case RequiredAcksAll:
+		return kafkaGo.RequireAll, nil
+	case RequiredAcksOne:
+		return kafkaGo.RequireOne, nil
+	case RequiredAcksNone:
+		return kafkaGo.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("kafka: unsupported required acks [%s]", acks)
+	}
+}
+
+// isAmbiguousError 判断错误是否无法确定消息是否已经写入，比如超时。
+func isAmbiguousError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var kerr kafkaGo.Error
+	if errors.As(err, &kerr) && kerr.Timeout() {
+		return true
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+var defaultRetryBackoff = retryBackoff{
+	Initial: 200 * time.Millisecond,
+	Max:     5 * time.Second,
+	Factor:  2,
+}
+
+// retryBackoff 带抖动的指数退避
+type retryBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+}
+
+// duration 第attempt次（从0开始）重试之前需要等待的时间
+func (r retryBackoff) duration(attempt int) time.Duration {
+	if r.Initial <= 0 {
+		return 0
+	}
+
+	factor := r.Factor
+	if factor < 1 {
+		factor = 1
+	}
+
+	d := float64(r.Initial) * math.Pow(factor, float64(attempt))
+	if r.Max > 0 && d > float64(r.Max) {
+		d = float64(r.Max)
+	}
+
+	// 在[d/2, d)之间随机取值，避免多个发送方同时重试
+	half := d / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// partitionWorker 根据主题和分区选择处理消息的协程
+func partitionWorker(msg kafkaGo.Message, workers int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(msg.Topic))
+	return int((h.Sum32() + uint32(msg.Partition)) % uint32(workers))
+}
+
+// loadTLSConfig 从文件加载CA证书和客户端证书，caFile为空时使用系统根证书，certFile和keyFile为空时不使用客户端证书
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// validateTLSConfig 检查TLS版本和加密套件的组合是否有效
+func validateTLSConfig(config *tls.Config) error {
+	minVersion, maxVersion := config.MinVersion, config.MaxVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	if maxVersion == 0 {
+		maxVersion = tls.VersionTLS13
+	}
+
+	if minVersion < tls.VersionTLS10 || minVersion > tls.VersionTLS13 {
+		return fmt.Errorf("%w: unknown min version 0x%04x", ErrInvalidTLSConfig, minVersion)
+	}
+	if maxVersion < minVersion {
+		return fmt.Errorf("%w: max version 0x%04x is lower than min version 0x%04x", ErrInvalidTLSConfig, maxVersion, minVersion)
+	}
+
+	if len(config.CipherSuites) == 0 {
+		return nil
+	}
+	if minVersion == tls.VersionTLS13 {
+		return fmt.Errorf("%w: cipher suites are not configurable with TLS 1.3", ErrInvalidTLSConfig)
+	}
+
+	suites := make(map[uint16]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.ID] = suite
+	}
+
+	for _, id := range config.CipherSuites {
+		suite, ok := suites[id]
+		if !ok {
+			return fmt.Errorf("%w: unknown cipher suite 0x%04x", ErrInvalidTLSConfig, id)
+		}
+
+		var supported bool
+		for _, v := range suite.SupportedVersions {
+			// TLS 1.3的加密套件由Go自动选择，配置了也不会生效
+			if v >= minVersion && v <= maxVersion && v != tls.VersionTLS13 {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("%w: cipher suite %s is not usable with the configured versions", ErrInvalidTLSConfig, suite.Name)
+		}
+	}
+
+	return nil
+}
+
+// newScramMechanism 根据算法名称创建SCRAM认证，支持sha256和sha512
+func newScramMechanism(algo, username, password string) (sasl.Mechanism, error) {
+	var algorithm scram.Algorithm
+	switch strings.ToLower(algo) {
+	case "sha256", "sha-256":
+		algorithm = scram.SHA256
+	case "sha512", "sha-512":
+		algorithm = scram.SHA512
+	default:
+		return nil, fmt.Errorf("kafka: unsupported scram algorithm: %s", algo)
+	}
+	return scram.Mechanism(algorithm, username, password)
+}
+
+// writerData 通过Message.WriterData传递给均衡器和完成回调的发送信息
+type writerData struct {
+	// partition 显式指定的分区，小于0表示未指定
+	partition int
+	attempts  int32
+}
+
+// MessageAttempts 返回消息实际写入的次数，包括第一次写入和重试，可以在WithCompletionHandler的回调中使用。
+func MessageAttempts(msg kafkaGo.Message) int {
+	if d, ok := msg.WriterData.(*writerData); ok {
+		return int(atomic.LoadInt32(&d.attempts))
+	}
+	return 1
+}
+
+// isTemporaryError broker返回的可以重试的错误，超时的错误无法确定消息是否已经写入，不在其中
+func isTemporaryError(err error) bool {
+	var kerr kafkaGo.Error
+	return errors.As(err, &kerr) && kerr.Temporary() && !kerr.Timeout()
+}
+
+// partitionBalancer 消息显式指定了分区时直接使用该分区，否则交给下一个均衡器
+type partitionBalancer struct {
+	next kafkaGo.Balancer
+}
+
+func newPartitionBalancer(next kafkaGo.Balancer) kafkaGo.Balancer {
+	if _, ok := next.(*partitionBalancer); ok {
+		return next
+	}
+	if next == nil {
+		next = &kafkaGo.RoundRobin{}
+	}
+	return &partitionBalancer{next: next}
+}
+
+// Balance 指定的分区不在主题的分区列表中时，记录日志并交给下一个均衡器，避免写入时才得到不明确的broker错误
+func (b *partitionBalancer) Balance(msg kafkaGo.Message, partitions ...int) int {
+	if d, ok := msg.WriterData.(*writerData); ok && d.partition >= 0 {
+		for _, p := range partitions {
+			if p == d.partition {
+				return d.partition
+			}
+		}
+		log.Warnf("[kafka]: partition [%d] does not exist in topic [%s] with partitions %v, fall back to the balancer", d.partition, msg.Topic, partitions)
+	}
+	return b.next.Balance(msg, partitions...)
+}
+
+// sameMessage 判断拦截器是否原样传递了消息体，只比较指针，其它类型总是视为不同
+func sameMessage(a, b broker.Any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() != reflect.Ptr || vb.Kind() != reflect.Ptr {
+		return false
+	}
+	return va.Type() == vb.Type() && va.Pointer() == vb.Pointer()
+}
@@ -76,12 +76,32 @@ type WriterConfig struct {
 
 	// AllowAutoTopicCreation notifies Writer to create topic if missing.
 	AllowAutoTopicCreation bool
+
+	// An optional function called when the writer succeeds or fails the
+	// delivery of messages to a kafka partition. When writing the messages
+	// fails, the `err` parameter will be non-nil.
+	//
+	// With Async enabled this is the only way to observe delivery errors.
+	Completion func(messages []kafkaGo.Message, err error)
+
+	// Compression set the compression codec to be used to compress messages.
+	//
+	// The default is to send messages uncompressed.
+	Compression kafkaGo.Compression
 }
 
+// WriterStatsHandler 定期接收Writer的统计信息，未开启一个主题一个Writer时topic为空
+type WriterStatsHandler func(topic string, stats kafkaGo.WriterStats)
+
 type Writer struct {
 	Writer                  *kafkaGo.Writer
 	Writers                 map[string]*kafkaGo.Writer
 	EnableOneTopicOneWriter bool
+
+	// Uncompressed 设置了WithCompressionThreshold时，不超过阈值的消息使用该缓存中不压缩的Writer发送
+	Uncompressed *Writer
+
+	noCompression bool
 }
 
 func NewWriter(enableOneTopicOneWriter bool) *Writer {
@@ -100,6 +120,51 @@ func (w *Writer) Close() {
 	}
 	w.Writer = nil
 	w.Writers = nil
+
+	if w.Uncompressed != nil {
+		w.Uncompressed.Close()
+	}
+}
+
+// get 获取缓存的Writer，未开启一个主题一个Writer时所有主题共用同一个Writer。
+func (w *Writer) get(topic string) (*kafkaGo.Writer, bool) {
+	if !w.EnableOneTopicOneWriter {
+		return w.Writer, w.Writer != nil
+	}
+	writer, ok := w.Writers[topic]
+	return writer, ok
+}
+
+func (w *Writer) set(topic string, writer *kafkaGo.Writer) {
+	if !w.EnableOneTopicOneWriter {
+		w.Writer = writer
+		return
+	}
+	if w.Writers == nil {
+		w.Writers = make(map[string]*kafkaGo.Writer)
+	}
+	w.Writers[topic] = writer
+}
+
+// Range 遍历缓存的Writer，包括不压缩的Writer
+func (w *Writer) Range(fn func(topic string, writer *kafkaGo.Writer)) {
+	if w.Writer != nil {
+		fn("", w.Writer)
+	}
+	for topic, writer := range w.Writers {
+		fn(topic, writer)
+	}
+	if w.Uncompressed != nil {
+		w.Uncompressed.Range(fn)
+	}
+}
+
+func (w *Writer) remove(topic string) {
+	if !w.EnableOneTopicOneWriter {
+		w.Writer = nil
+		return
+	}
+	delete(w.Writers, topic)
 }
 
 // CreateProducer create kafka-go Writer
@@ -125,6 +190,11 @@ func (w *Writer) CreateProducer(writerConfig WriterConfig, saslMechanism sasl.Me
 		Logger:                 writerConfig.Logger,
 		ErrorLogger:            writerConfig.ErrorLogger,
 		AllowAutoTopicCreation: writerConfig.AllowAutoTopicCreation,
+		Compression:            writerConfig.Compression,
+		Completion:             writerConfig.Completion,
+	}
+	if w.noCompression {
+		writer.Compression = 0
 	}
 
 	return writer
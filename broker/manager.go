@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrBrokerNotFound = errors.New("broker not found")
+	ErrBrokerExists   = errors.New("broker already registered")
+)
+
+// Manager 管理多个命名的Broker，例如同时连接多个集群，按名称发送和订阅消息
+type Manager struct {
+	sync.RWMutex
+
+	opts    []Option
+	brokers map[string]Broker
+}
+
+// NewManager opts是所有Broker共用的选项，例如编解码器和链路追踪，注册时用于初始化Broker
+func NewManager(opts ...Option) *Manager {
+	return &Manager{
+		opts:    opts,
+		brokers: make(map[string]Broker),
+	}
+}
+
+// Register 注册名为name的Broker，并使用共用的选项初始化。
+// 已经初始化过的Broker会再次调用Init，Broker需要支持重复初始化。
+func (m *Manager) Register(name string, b Broker) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.brokers[name]; ok {
+		return fmt.Errorf("%w: %s", ErrBrokerExists, name)
+	}
+
+	if err := b.Init(m.opts...); err != nil {
+		return err
+	}
+
+	m.brokers[name] = b
+	return nil
+}
+
+// Get 获取名为name的Broker
+func (m *Manager) Get(name string) (Broker, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	b, ok := m.brokers[name]
+	return b, ok
+}
+
+// Names 所有已注册的Broker名称，按字母排序
+func (m *Manager) Names() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	names := make([]string, 0, len(m.brokers))
+	for name := range m.brokers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *Manager) Publish(name, topic string, msg Any, opts ...PublishOption) error {
+	b, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	return b.Publish(topic, msg, opts...)
+}
+
+func (m *Manager) Subscribe(name, topic string, handler Handler, binder Binder, opts ...SubscribeOption) (Subscriber, error) {
+	b, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.Subscribe(topic, handler, binder, opts...)
+}
+
+// Connect 按名称顺序连接所有Broker，遇到错误时停止并返回
+func (m *Manager) Connect() error {
+	for _, name := range m.Names() {
+		b, err := m.get(name)
+		if err != nil {
+			continue
+		}
+		if err = b.Connect(); err != nil {
+			return fmt.Errorf("broker %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Disconnect 断开所有Broker，返回第一个错误
+func (m *Manager) Disconnect() error {
+	var first error
+	for _, name := range m.Names() {
+		b, err := m.get(name)
+		if err != nil {
+			continue
+		}
+		if err = b.Disconnect(); err != nil && first == nil {
+			first = fmt.Errorf("broker %s: %w", name, err)
+		}
+	}
+	return first
+}
+
+func (m *Manager) get(name string) (Broker, error) {
+	b, ok := m.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBrokerNotFound, name)
+	}
+	return b, nil
+}
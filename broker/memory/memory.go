@@ -0,0 +1,188 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+var (
+	// ErrNotConnected 未连接时发送消息
+	ErrNotConnected = errors.New("memory: not connected")
+
+	// ErrNilHandler 订阅时处理函数为nil
+	ErrNilHandler = errors.New("memory: handler is nil")
+)
+
+type memoryBroker struct {
+	sync.RWMutex
+
+	opts      broker.Options
+	connected bool
+
+	// 主题 -> 分组 -> 订阅者，同一个分组内的订阅者轮流接收消息
+	subscribers map[string]map[string]*group
+}
+
+type group struct {
+	subscribers []*subscriber
+	next        int
+}
+
+// NewBroker 创建一个进程内的Broker，消息不经过网络，适用于单元测试。
+// 同一个主题的不同分组都会收到消息，同一个分组内的订阅者轮流接收消息，未指定分组时每个订阅者独占一个分组。
+// 消息放入订阅者的队列后Publish立即返回，处理函数中可以向同一个主题发送消息。
+func NewBroker(opts ...broker.Option) broker.Broker {
+	options := broker.NewOptionsAndApply(opts...)
+
+	return &memoryBroker{
+		opts:        options,
+		subscribers: make(map[string]map[string]*group),
+	}
+}
+
+func (b *memoryBroker) Name() string {
+	return "memory"
+}
+
+func (b *memoryBroker) Options() broker.Options {
+	return b.opts
+}
+
+func (b *memoryBroker) Address() string {
+	return ""
+}
+
+func (b *memoryBroker) Init(opts ...broker.Option) error {
+	b.opts.Apply(opts...)
+	return b.opts.CheckTopicCodecs()
+}
+
+func (b *memoryBroker) Connect() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.connected = true
+	return nil
+}
+
+func (b *memoryBroker) Disconnect() error {
+	b.Lock()
+	var subs []*subscriber
+	for _, groups := range b.subscribers {
+		for _, g := range groups {
+			subs = append(subs, g.subscribers...)
+		}
+	}
+	b.subscribers = make(map[string]map[string]*group)
+	b.connected = false
+	b.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+		<-sub.done
+	}
+	return nil
+}
+
+func (b *memoryBroker) Publish(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+	return broker.ChainProducerInterceptors(b.publish, b.opts.ProducerInterceptors...)(topic, msg, opts...)
+}
+
+func (b *memoryBroker) publish(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+	buf, err := broker.Marshal(b.opts.CodecFor(topic), msg)
+	if err != nil {
+		return err
+	}
+
+	options := broker.NewPublishOptions(opts...)
+	headers, _ := options.Context.Value(headersKey{}).(map[string]string)
+
+	b.Lock()
+	if !b.connected {
+		b.Unlock()
+		return ErrNotConnected
+	}
+	var targets []*subscriber
+	for _, g := range b.subscribers[topic] {
+		targets = append(targets, g.subscribers[g.next%len(g.subscribers)])
+		g.next++
+	}
+	b.Unlock()
+
+	for _, sub := range targets {
+		// 每个订阅者使用单独的消息头，处理函数修改消息头不会影响其他订阅者
+		h := make(broker.Headers, len(headers))
+		for k, v := range headers {
+			h[k] = v
+		}
+		sub.deliver(&message{body: buf, headers: h})
+	}
+
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(topic string, handler broker.Handler, binder broker.Binder, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+
+	options := broker.NewSubscribeOptions(opts...)
+
+	queue := options.Queue
+	if queue == "" {
+		queue = uuid.New().String()
+	}
+
+	sub := &subscriber{
+		b:       b,
+		topic:   topic,
+		handler: broker.ChainConsumerInterceptors(handler, b.opts.ConsumerInterceptors...),
+		binder:  binder,
+		opts:    options,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	b.Lock()
+	groups, ok := b.subscribers[topic]
+	if !ok {
+		groups = make(map[string]*group)
+		b.subscribers[topic] = groups
+	}
+	g, ok := groups[queue]
+	if !ok {
+		g = &group{}
+		groups[queue] = g
+	}
+	g.subscribers = append(g.subscribers, sub)
+	b.Unlock()
+
+	go sub.run()
+
+	return sub, nil
+}
+
+func (b *memoryBroker) removeSubscriber(sub *subscriber) {
+	b.Lock()
+	defer b.Unlock()
+
+	for queue, g := range b.subscribers[sub.topic] {
+		for i, s := range g.subscribers {
+			if s != sub {
+				continue
+			}
+			g.subscribers = append(g.subscribers[:i], g.subscribers[i+1:]...)
+			if len(g.subscribers) == 0 {
+				delete(b.subscribers[sub.topic], queue)
+			}
+			if len(b.subscribers[sub.topic]) == 0 {
+				delete(b.subscribers, sub.topic)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/go-kratos/kratos/v2/encoding/json"
+	_ "github.com/go-kratos/kratos/v2/encoding/xml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+const testTopic = "test_topic"
+
+type testMessage struct {
+	Value int `json:"value"`
+}
+
+func newTestBroker(t *testing.T) broker.Broker {
+	b := NewBroker(broker.WithCodec("json"))
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	return b
+}
+
+func subscribe(t *testing.T, b broker.Broker, ch chan int, opts ...broker.SubscribeOption) broker.Subscriber {
+	sub, err := b.Subscribe(testTopic, func(_ context.Context, event broker.Event) error {
+		ch <- event.Message().Body.(*testMessage).Value
+		return nil
+	}, func() broker.Any {
+		return &testMessage{}
+	}, opts...)
+	assert.Nil(t, err)
+	return sub
+}
+
+func receive(t *testing.T, ch chan int) int {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		assert.Fail(t, "message should be received within 1 second")
+		return -1
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Disconnect()
+
+	ch1 := make(chan int, 10)
+	ch2 := make(chan int, 10)
+	subscribe(t, b, ch1)
+	sub2 := subscribe(t, b, ch2)
+
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: 1}))
+	assert.Equal(t, 1, receive(t, ch1))
+	assert.Equal(t, 1, receive(t, ch2))
+
+	assert.Nil(t, sub2.Unsubscribe())
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: 2}))
+	assert.Equal(t, 2, receive(t, ch1))
+	assert.Len(t, ch2, 0)
+}
+
+func TestQueueGroup(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Disconnect()
+
+	ch := make(chan int, 10)
+	subscribe(t, b, ch, broker.WithQueueName("group"))
+	subscribe(t, b, ch, broker.WithQueueName("group"))
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, b.Publish(testTopic, &testMessage{Value: i}))
+	}
+
+	sum := 0
+	for i := 0; i < 4; i++ {
+		sum += receive(t, ch)
+	}
+	assert.Equal(t, 6, sum)
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, ch, 0)
+}
+
+func TestHeaders(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Disconnect()
+
+	headers := make(chan broker.Headers, 10)
+	_, err := b.Subscribe(testTopic, func(_ context.Context, event broker.Event) error {
+		headers <- event.Message().Headers
+		return nil
+	}, func() broker.Any {
+		return &testMessage{}
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: 1}, WithHeaders(map[string]string{"id": "1"})))
+	select {
+	case h := <-headers:
+		assert.Equal(t, "1", h["id"])
+	case <-time.After(time.Second):
+		assert.Fail(t, "message should be received within 1 second")
+	}
+
+	_, err = b.Subscribe(testTopic, nil, nil)
+	assert.True(t, errors.Is(err, ErrNilHandler))
+}
+
+func TestPublishFromHandler(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Disconnect()
+
+	// 处理函数向同一个主题发送大量消息也不会阻塞
+	const total = 5000
+	ch := make(chan int, total)
+	_, err := b.Subscribe(testTopic, func(_ context.Context, event broker.Event) error {
+		value := event.Message().Body.(*testMessage).Value
+		if value == 0 {
+			for i := 1; i <= total; i++ {
+				if err := b.Publish(testTopic, &testMessage{Value: i}); err != nil {
+					return err
+				}
+			}
+		}
+		ch <- value
+		return nil
+	}, func() broker.Any {
+		return &testMessage{}
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: 0}))
+	for i := 0; i <= total; i++ {
+		assert.Equal(t, i, receive(t, ch))
+	}
+}
+
+func TestPublishNotConnected(t *testing.T) {
+	b := NewBroker(broker.WithCodec("json"))
+	assert.Equal(t, ErrNotConnected, b.Publish(testTopic, &testMessage{Value: 1}))
+}
+
+func TestInterceptors(t *testing.T) {
+	var order []string
+	producer := func(name string) broker.ProducerInterceptor {
+		return func(next broker.PublishFunc) broker.PublishFunc {
+			return func(topic string, msg broker.Any, opts ...broker.PublishOption) error {
+				order = append(order, name)
+				// 丢弃负数
+				if msg.(*testMessage).Value < 0 {
+					return nil
+				}
+				return next(topic, msg, opts...)
+			}
+		}
+	}
+	consumer := func(next broker.Handler) broker.Handler {
+		return func(ctx context.Context, event broker.Event) error {
+			// 丢弃奇数
+			if event.Message().Body.(*testMessage).Value%2 == 1 {
+				return nil
+			}
+			return next(ctx, event)
+		}
+	}
+
+	b := NewBroker(
+		broker.WithCodec("json"),
+		broker.WithProducerInterceptor(producer("first"), producer("second")),
+		broker.WithConsumerInterceptor(consumer),
+	)
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	defer b.Disconnect()
+
+	ch := make(chan int, 10)
+	subscribe(t, b, ch)
+
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: -1}))
+	assert.Equal(t, []string{"first"}, order)
+
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, b.Publish(testTopic, &testMessage{Value: i}))
+	}
+	assert.Equal(t, 2, receive(t, ch))
+	assert.Equal(t, 4, receive(t, ch))
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, ch, 0)
+	assert.Equal(t, []string{"first", "first", "second"}, order[:3])
+}
+
+func TestTopicCodec(t *testing.T) {
+	const xmlTopic = "xml_topic"
+
+	b := NewBroker(
+		broker.WithCodec("json"),
+		broker.WithTopicCodec(xmlTopic, "xml"),
+	)
+	assert.Nil(t, b.Init())
+	assert.Nil(t, b.Connect())
+	defer b.Disconnect()
+
+	raw := make(chan []byte, 10)
+	_, err := b.Subscribe(xmlTopic, func(_ context.Context, event broker.Event) error {
+		raw <- event.Message().Body.([]byte)
+		return nil
+	}, nil, broker.WithRawBody())
+	assert.Nil(t, err)
+
+	ch := make(chan int, 10)
+	subscribe(t, b, ch)
+
+	assert.Nil(t, b.Publish(xmlTopic, &testMessage{Value: 1}))
+	select {
+	case data := <-raw:
+		assert.Equal(t, "<testMessage><Value>1</Value></testMessage>", string(data))
+	case <-time.After(time.Second):
+		assert.Fail(t, "message should be received within 1 second")
+	}
+
+	// 其他主题仍然使用全局的编解码器
+	assert.Nil(t, b.Publish(testTopic, &testMessage{Value: 2}))
+	assert.Equal(t, 2, receive(t, ch))
+
+	// 没有注册的编解码器在Init时报错
+	err = NewBroker(broker.WithTopicCodec(xmlTopic, "unknown")).Init()
+	assert.True(t, errors.Is(err, broker.ErrUnknownCodec))
+}
+
+func TestManager(t *testing.T) {
+	m := broker.NewManager(broker.WithCodec("json"))
+
+	assert.Nil(t, m.Register("primary", NewBroker()))
+	assert.Nil(t, m.Register("secondary", NewBroker()))
+	assert.True(t, errors.Is(m.Register("primary", NewBroker()), broker.ErrBrokerExists))
+	assert.Equal(t, []string{"primary", "secondary"}, m.Names())
+
+	assert.Nil(t, m.Connect())
+	defer m.Disconnect()
+
+	primary, secondary := make(chan int, 10), make(chan int, 10)
+	for name, ch := range map[string]chan int{"primary": primary, "secondary": secondary} {
+		ch := ch
+		_, err := m.Subscribe(name, testTopic, func(_ context.Context, event broker.Event) error {
+			ch <- event.Message().Body.(*testMessage).Value
+			return nil
+		}, func() broker.Any {
+			return &testMessage{}
+		})
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, m.Publish("secondary", testTopic, &testMessage{Value: 2}))
+	assert.Equal(t, 2, receive(t, secondary))
+	assert.Empty(t, primary)
+
+	assert.True(t, errors.Is(m.Publish("none", testTopic, &testMessage{}), broker.ErrBrokerNotFound))
+}
@@ -0,0 +1,12 @@
+package memory
+
+import (
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+type headersKey struct{}
+
+// WithHeaders 消息头，订阅者通过Message().Headers获取
+func WithHeaders(headers map[string]string) broker.PublishOption {
+	return broker.PublishContextWithValue(headersKey{}, headers)
+}
@@ -0,0 +1,27 @@
+package memory
+
+import "github.com/tx7do/kratos-transport/broker"
+
+type publication struct {
+	topic   string
+	message *broker.Message
+	err     error
+	acked   bool
+}
+
+func (p *publication) Topic() string {
+	return p.topic
+}
+
+func (p *publication) Message() *broker.Message {
+	return p.message
+}
+
+func (p *publication) Ack() error {
+	p.acked = true
+	return nil
+}
+
+func (p *publication) Error() error {
+	return p.err
+}
@@ -0,0 +1,134 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+type subscriber struct {
+	b       *memoryBroker
+	topic   string
+	handler broker.Handler
+	binder  broker.Binder
+	opts    broker.SubscribeOptions
+
+	notify chan struct{}
+	done   chan struct{}
+
+	mu     sync.Mutex
+	queue  []*message
+	closed bool
+}
+
+// message 等待订阅者处理的消息
+type message struct {
+	body    []byte
+	headers broker.Headers
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *subscriber) Topic() string {
+	return s.topic
+}
+
+func (s *subscriber) Unsubscribe() error {
+	s.b.removeSubscriber(s)
+	s.close()
+	<-s.done
+	return nil
+}
+
+// close 标记订阅已关闭，队列中剩余的消息处理完之后退出
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.signal()
+	}
+}
+
+// deliver 将消息放入订阅者的队列，不会阻塞，已取消订阅时丢弃
+func (s *subscriber) deliver(msg *message) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// signal 通知处理协程队列有变化
+func (s *subscriber) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.done)
+
+	for {
+		s.mu.Lock()
+		queue, closed := s.queue, s.closed
+		s.queue = nil
+		s.mu.Unlock()
+
+		if len(queue) == 0 {
+			if closed {
+				return
+			}
+			<-s.notify
+			continue
+		}
+
+		for _, msg := range queue {
+			s.onMessage(msg)
+		}
+	}
+}
+
+func (s *subscriber) onMessage(msg *message) {
+	buf := msg.body
+	m := &broker.Message{
+		Headers: msg.headers,
+	}
+
+	if s.binder != nil && !s.opts.RawBody {
+		m.Body = s.binder()
+	} else {
+		m.Body = buf
+	}
+
+	p := &publication{
+		topic:   s.topic,
+		message: m,
+	}
+
+	if !s.opts.RawBody {
+		if p.err = broker.Unmarshal(s.b.opts.CodecFor(s.topic), buf, &m.Body); p.err != nil {
+			log.Errorf("[memory]: unmarshal message failed: %v", p.err)
+			return
+		}
+	}
+
+	if p.err = s.handler(s.opts.Context, p); p.err != nil {
+		log.Errorf("[memory]: process message failed: %v", p.err)
+		return
+	}
+
+	if s.opts.AutoAck {
+		_ = p.Ack()
+	}
+}
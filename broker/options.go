@@ -3,7 +3,12 @@ package broker
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 
@@ -16,6 +21,11 @@ var (
 	DefaultCodec encoding.Codec = nil
 )
 
+var (
+	// ErrUnknownCodec WithTopicCodec指定的编解码器没有注册
+	ErrUnknownCodec = errors.New("unknown codec")
+)
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type Options struct {
@@ -23,6 +33,12 @@ type Options struct {
 
 	Codec encoding.Codec
 
+	// TopicCodecs 按主题覆盖Codec，主题没有设置时使用Codec
+	TopicCodecs map[string]encoding.Codec
+
+	// unknownTopicCodecs WithTopicCodec指定的没有注册的编解码器，主题 -> 编解码器名称
+	unknownTopicCodecs map[string]string
+
 	ErrorHandler Handler
 
 	Secure    bool
@@ -31,6 +47,11 @@ type Options struct {
 	Context context.Context
 
 	Tracings []tracing.Option
+
+	MeterProvider metric.MeterProvider
+
+	ProducerInterceptors []ProducerInterceptor
+	ConsumerInterceptors []ConsumerInterceptor
 }
 
 type Option func(*Options)
@@ -96,6 +117,50 @@ func WithCodec(name string) Option {
 	}
 }
 
+// WithTopicCodec 主题topic使用名为name的编解码器，其他主题仍然使用WithCodec设置的编解码器，
+// 可用于在不同的序列化格式之间逐个主题迁移。编解码器没有注册时，Broker的Init返回ErrUnknownCodec。
+func WithTopicCodec(topic, name string) Option {
+	return func(o *Options) {
+		codec := encoding.GetCodec(name)
+		if codec == nil {
+			if o.unknownTopicCodecs == nil {
+				o.unknownTopicCodecs = make(map[string]string)
+			}
+			o.unknownTopicCodecs[topic] = name
+			return
+		}
+
+		delete(o.unknownTopicCodecs, topic)
+		if o.TopicCodecs == nil {
+			o.TopicCodecs = make(map[string]encoding.Codec)
+		}
+		o.TopicCodecs[topic] = codec
+	}
+}
+
+// CheckTopicCodecs WithTopicCodec指定的编解码器没有注册时返回ErrUnknownCodec，由Broker在Init中调用
+func (o *Options) CheckTopicCodecs() error {
+	if len(o.unknownTopicCodecs) == 0 {
+		return nil
+	}
+
+	topics := make([]string, 0, len(o.unknownTopicCodecs))
+	for topic := range o.unknownTopicCodecs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return fmt.Errorf("%w: %s for topic %s", ErrUnknownCodec, o.unknownTopicCodecs[topics[0]], topics[0])
+}
+
+// CodecFor 返回主题使用的编解码器
+func (o *Options) CodecFor(topic string) encoding.Codec {
+	if codec, ok := o.TopicCodecs[topic]; ok {
+		return codec
+	}
+	return o.Codec
+}
+
 func WithErrorHandler(handler Handler) Option {
 	return func(o *Options) {
 		o.ErrorHandler = handler
@@ -141,6 +206,35 @@ func WithGlobalPropagator() Option {
 	}
 }
 
+// WithMeterProvider set meter provider, enable metrics.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(opt *Options) {
+		opt.MeterProvider = provider
+	}
+}
+
+// WithGlobalMeterProvider use the global meter provider, enable metrics.
+func WithGlobalMeterProvider() Option {
+	return func(opt *Options) {
+		opt.MeterProvider = otel.GetMeterProvider()
+	}
+}
+
+// WithProducerInterceptor 添加发送拦截器，可以修改、丢弃消息或者记录日志。
+// Kafka的所有发送方法都经过拦截器，批量发送时每条消息分别调用，转发到死信主题的消息不经过拦截器。
+func WithProducerInterceptor(interceptors ...ProducerInterceptor) Option {
+	return func(opt *Options) {
+		opt.ProducerInterceptors = append(opt.ProducerInterceptors, interceptors...)
+	}
+}
+
+// WithConsumerInterceptor 添加消费拦截器，包装订阅时传入的处理函数
+func WithConsumerInterceptor(interceptors ...ConsumerInterceptor) Option {
+	return func(opt *Options) {
+		opt.ConsumerInterceptors = append(opt.ConsumerInterceptors, interceptors...)
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type PublishOptions struct {
@@ -186,6 +280,12 @@ type SubscribeOptions struct {
 	AutoAck bool
 	Queue   string
 	Context context.Context
+
+	// RawBody 为true时不解码消息，Body是原始的字节数组
+	RawBody bool
+
+	// KeyBinder 不为nil时用它创建消息键的解码目标，支持的Broker会用编解码器解码消息键
+	KeyBinder Binder
 }
 
 type SubscribeOption func(*SubscribeOptions)
@@ -223,6 +323,20 @@ func DisableAutoAck() SubscribeOption {
 	}
 }
 
+// WithRawBody 不使用编解码器解码，处理函数收到的Body是原始的[]byte，同时忽略binder
+func WithRawBody() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.RawBody = true
+	}
+}
+
+// WithKeyBinder 使用编解码器把消息键解码到binder创建的对象中
+func WithKeyBinder(binder Binder) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.KeyBinder = binder
+	}
+}
+
 func WithQueueName(name string) SubscribeOption {
 	return func(o *SubscribeOptions) {
 		o.Queue = name
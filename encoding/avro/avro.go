@@ -0,0 +1,123 @@
+// Package avro defines the Avro codec which uses the Confluent Schema Registry
+// wire format: a zero magic byte, a 4-byte big-endian schema ID and the Avro
+// encoded body. Use WithSchemaRegistry to make a broker encode with it.
+package avro
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+// Name is the name of the avro codec.
+const Name = "avro"
+
+const (
+	magicByte  byte = 0
+	headerSize      = 5
+)
+
+var ErrInvalidWireFormat = errors.New("avro: invalid wire format")
+
+type Option func(*Codec)
+
+// WithSchema 第一次编码时把schema注册到subject，不设置时使用subject最新版本的Schema
+func WithSchema(schema string) Option {
+	return func(c *Codec) {
+		c.schemaText = schema
+	}
+}
+
+// WithSchemaRegistry Broker使用url处的Schema Registry进行Avro编解码，编码时使用subject的Schema
+func WithSchemaRegistry(url, subject string, opts ...Option) broker.Option {
+	return func(o *broker.Options) {
+		o.Codec = NewCodec(NewRegistry(url, nil), subject, opts...)
+	}
+}
+
+// Codec 编码时使用subject的Schema，解码时使用消息头中的Schema ID从Registry获取Schema
+type Codec struct {
+	registry   *Registry
+	subject    string
+	schemaText string
+
+	mu     sync.Mutex
+	id     int
+	schema avro.Schema
+}
+
+func NewCodec(registry *Registry, subject string, opts ...Option) *Codec {
+	c := &Codec{
+		registry: registry,
+		subject:  subject,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	id, schema, err := c.writerSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := avro.Marshal(schema, v)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(body))
+	buf[0] = magicByte
+	binary.BigEndian.PutUint32(buf[1:headerSize], uint32(id))
+	return append(buf, body...), nil
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < headerSize || data[0] != magicByte {
+		return ErrInvalidWireFormat
+	}
+
+	schema, err := c.registry.SchemaByID(int(binary.BigEndian.Uint32(data[1:headerSize])))
+	if err != nil {
+		return err
+	}
+
+	return avro.Unmarshal(schema, data[headerSize:], v)
+}
+
+func (c *Codec) Name() string {
+	return Name
+}
+
+// writerSchema 获取编码使用的Schema，获取成功后缓存
+func (c *Codec) writerSchema() (int, avro.Schema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.schema != nil {
+		return c.id, c.schema, nil
+	}
+
+	var (
+		id     int
+		schema avro.Schema
+		err    error
+	)
+	if c.schemaText != "" {
+		id, schema, err = c.registry.Register(c.subject, c.schemaText)
+	} else {
+		id, schema, err = c.registry.Latest(c.subject)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.id, c.schema = id, schema
+	return id, schema, nil
+}
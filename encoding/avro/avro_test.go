@@ -0,0 +1,118 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+const testSchema = `{
+	"type": "record",
+	"name": "Hygrothermograph",
+	"fields": [
+		{"name": "humidity", "type": "float"},
+		{"name": "temperature", "type": "float"}
+	]
+}`
+
+type hygrothermograph struct {
+	Humidity    float32 `avro:"humidity"`
+	Temperature float32 `avro:"temperature"`
+}
+
+// fakeRegistry 只实现了测试用到的接口
+type fakeRegistry struct {
+	sync.Mutex
+	schemas  map[int]string
+	subjects map[string]int
+}
+
+func newFakeRegistry() *httptest.Server {
+	r := &fakeRegistry{schemas: map[int]string{}, subjects: map[string]int{}}
+	return httptest.NewServer(r)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	path := req.URL.Path
+	switch {
+	case req.Method == http.MethodPost && strings.HasPrefix(path, "/subjects/"):
+		var body struct {
+			Schema string `json:"schema"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		subject := strings.TrimSuffix(strings.TrimPrefix(path, "/subjects/"), "/versions")
+		id := len(r.schemas) + 1
+		r.schemas[id] = body.Schema
+		r.subjects[subject] = id
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+
+	case strings.HasSuffix(path, "/versions/latest"):
+		subject := strings.TrimSuffix(strings.TrimPrefix(path, "/subjects/"), "/versions/latest")
+		id, ok := r.subjects[subject]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 40401, "message": "Subject not found"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "schema": r.schemas[id]})
+
+	case strings.HasPrefix(path, "/schemas/ids/"):
+		var id int
+		_ = json.Unmarshal([]byte(strings.TrimPrefix(path, "/schemas/ids/")), &id)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"schema": r.schemas[id]})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	srv := newFakeRegistry()
+	defer srv.Close()
+
+	registry := NewRegistry(srv.URL, nil)
+
+	_, _, err := registry.Latest("sensor-value")
+	assert.NotNil(t, err)
+
+	producer := NewCodec(registry, "sensor-value", WithSchema(testSchema))
+	in := hygrothermograph{Humidity: 48.5, Temperature: 21.25}
+
+	data, err := producer.Marshal(&in)
+	require.Nil(t, err)
+	assert.Equal(t, byte(0), data[0])
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(data[1:5]))
+
+	// 使用最新版本的Schema，解码时只依赖消息中的Schema ID
+	consumer := NewCodec(NewRegistry(srv.URL, nil), "sensor-value")
+	var out hygrothermograph
+	require.Nil(t, consumer.Unmarshal(data, &out))
+	assert.Equal(t, in, out)
+
+	again, err := consumer.Marshal(&in)
+	require.Nil(t, err)
+	assert.Equal(t, data, again)
+
+	assert.Equal(t, ErrInvalidWireFormat, consumer.Unmarshal([]byte{1, 0}, &out))
+}
+
+func TestWithSchemaRegistry(t *testing.T) {
+	srv := newFakeRegistry()
+	defer srv.Close()
+
+	opts := broker.NewOptionsAndApply(WithSchemaRegistry(srv.URL, "sensor-value"))
+	require.NotNil(t, opts.Codec)
+	assert.Equal(t, Name, opts.Codec.Name())
+}
@@ -0,0 +1,128 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// Registry Confluent Schema Registry的客户端，按ID缓存已经解析的Schema
+type Registry struct {
+	url    string
+	client *http.Client
+
+	mu      sync.RWMutex
+	schemas map[int]avro.Schema
+}
+
+// NewRegistry 创建Schema Registry客户端，client为nil时使用http.DefaultClient
+func NewRegistry(registryURL string, client *http.Client) *Registry {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Registry{
+		url:     strings.TrimRight(registryURL, "/"),
+		client:  client,
+		schemas: make(map[int]avro.Schema),
+	}
+}
+
+type schemaResponse struct {
+	ID     int    `json:"id"`
+	Schema string `json:"schema"`
+}
+
+type errorResponse struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Latest 获取subject最新版本的Schema
+func (r *Registry) Latest(subject string) (int, avro.Schema, error) {
+	var resp schemaResponse
+	if err := r.do(http.MethodGet, "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, &resp); err != nil {
+		return 0, nil, err
+	}
+	schema, err := r.parse(resp.ID, resp.Schema)
+	return resp.ID, schema, err
+}
+
+// Register 在subject下注册Schema，Schema已经存在时返回已有的ID
+func (r *Registry) Register(subject, schema string) (int, avro.Schema, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var resp schemaResponse
+	if err = r.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &resp); err != nil {
+		return 0, nil, err
+	}
+	parsed, err := r.parse(resp.ID, schema)
+	return resp.ID, parsed, err
+}
+
+// SchemaByID 根据ID获取Schema
+func (r *Registry) SchemaByID(id int) (avro.Schema, error) {
+	r.mu.RLock()
+	schema, ok := r.schemas[id]
+	r.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	var resp schemaResponse
+	if err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return r.parse(id, resp.Schema)
+}
+
+func (r *Registry) parse(id int, text string) (avro.Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if schema, ok := r.schemas[id]; ok {
+		return schema, nil
+	}
+
+	schema, err := avro.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	r.schemas[id] = schema
+	return schema, nil
+}
+
+func (r *Registry) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("avro: schema registry %s %s: %d %s", method, path, resp.StatusCode, e.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
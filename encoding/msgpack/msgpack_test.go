@@ -0,0 +1,69 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/encoding"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+type sensorData struct {
+	Name      string            `json:"name" msgpack:"name"`
+	Values    []float64         `json:"values" msgpack:"values"`
+	Labels    map[string]string `json:"labels" msgpack:"labels"`
+	Timestamp time.Time         `json:"timestamp" msgpack:"timestamp"`
+}
+
+func newSensorData() *sensorData {
+	return &sensorData{
+		Name:      "hygrothermograph",
+		Values:    []float64{21.5, 48.25, 1013.1},
+		Labels:    map[string]string{"room": "server", "floor": "3"},
+		Timestamp: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestCodec(t *testing.T) {
+	codec := encoding.GetCodec(Name)
+	assert.NotNil(t, codec)
+
+	in := newSensorData()
+	buf, err := broker.Marshal(codec, in)
+	assert.Nil(t, err)
+
+	var body broker.Any = &sensorData{}
+	assert.Nil(t, broker.Unmarshal(codec, buf, &body))
+
+	out := body.(*sensorData)
+	assert.Equal(t, in.Name, out.Name)
+	assert.Equal(t, in.Values, out.Values)
+	assert.Equal(t, in.Labels, out.Labels)
+	assert.True(t, in.Timestamp.Equal(out.Timestamp))
+}
+
+func BenchmarkMarshalMsgpack(b *testing.B) {
+	codec := encoding.GetCodec(Name)
+	in := newSensorData()
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		buf, _ := codec.Marshal(in)
+		size = len(buf)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	in := newSensorData()
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		buf, _ := json.Marshal(in)
+		size = len(buf)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
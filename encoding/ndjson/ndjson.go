@@ -0,0 +1,93 @@
+// Package ndjson defines the newline-delimited JSON codec, which packs a slice
+// of records into one message, one JSON document per line. Importing this
+// package will register the codec.
+package ndjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/go-kratos/kratos/v2/encoding"
+)
+
+// Name is the name registered for the ndjson codec.
+const Name = "ndjson"
+
+var ErrNotSlice = errors.New("ndjson: value must be a slice")
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec 编码时每条记录占一行，解码时按行拆分并追加到切片中
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, ErrNotSlice
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < rv.Len(); i++ {
+		line, err := json.Marshal(rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal v必须指向切片，binder返回nil时解码为[]interface{}
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	rv := indirect(reflect.ValueOf(v))
+
+	switch {
+	case rv.Kind() == reflect.Slice && rv.CanSet():
+	case rv.Kind() == reflect.Interface && rv.IsNil() && rv.CanSet():
+		var records []interface{}
+		if err := unmarshalLines(data, reflect.ValueOf(&records).Elem()); err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(records))
+		return nil
+	default:
+		return ErrNotSlice
+	}
+
+	return unmarshalLines(data, rv)
+}
+
+func (codec) Name() string {
+	return Name
+}
+
+func unmarshalLines(data []byte, slice reflect.Value) error {
+	elemType := slice.Type().Elem()
+	slice.SetLen(0)
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		elem := reflect.New(elemType)
+		if err := json.Unmarshal(line, elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
+
+// indirect 解开指针和接口，直到遇到非指针的值或者nil
+func indirect(rv reflect.Value) reflect.Value {
+	for (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	return rv
+}
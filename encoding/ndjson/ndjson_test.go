@@ -0,0 +1,44 @@
+package ndjson
+
+import (
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/encoding"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tx7do/kratos-transport/broker"
+)
+
+type logLine struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func TestCodec(t *testing.T) {
+	codec := encoding.GetCodec(Name)
+	assert.NotNil(t, codec)
+
+	in := []logLine{
+		{Level: "info", Message: "service started"},
+		{Level: "error", Message: "connection lost"},
+	}
+	buf, err := broker.Marshal(codec, &in)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"level\":\"info\",\"message\":\"service started\"}\n{\"level\":\"error\",\"message\":\"connection lost\"}\n", string(buf))
+
+	// 与订阅时binder的用法相同
+	var body broker.Any = &[]logLine{}
+	assert.Nil(t, broker.Unmarshal(codec, append(buf, "\r\n\n"...), &body))
+	assert.Equal(t, in, *body.(*[]logLine))
+
+	var records broker.Any
+	assert.Nil(t, broker.Unmarshal(codec, buf, &records))
+	assert.Len(t, records, 2)
+	assert.Equal(t, "connection lost", records.([]interface{})[1].(map[string]interface{})["message"])
+
+	_, err = broker.Marshal(codec, &logLine{})
+	assert.Equal(t, ErrNotSlice, err)
+
+	body = &logLine{}
+	assert.Equal(t, ErrNotSlice, broker.Unmarshal(codec, buf, &body))
+}
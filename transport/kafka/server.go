@@ -114,19 +114,28 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
-func (s *Server) Stop(_ context.Context) error {
+func (s *Server) Stop(ctx context.Context) error {
 	if s.started == false {
 		return nil
 	}
 	log.Info("[kafka] server stopping")
 
-	for _, v := range s.subscribers {
-		_ = v.Unsubscribe()
-	}
+	subscribers := s.subscribers
 	s.subscribers = SubscriberMap{}
 	s.subscriberOpts = SubscribeOptionMap{}
 
 	s.started = false
+
+	// 优先使用Broker的优雅停止，等待正在处理的消息完成
+	if stopper, ok := s.Broker.(interface {
+		Stop(ctx context.Context) error
+	}); ok {
+		return stopper.Stop(ctx)
+	}
+
+	for _, v := range subscribers {
+		_ = v.Unsubscribe()
+	}
 	return s.Disconnect()
 }
 
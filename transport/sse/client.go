@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +31,13 @@ func ClientMaxBufferSize(s int) func(c *Client) {
 	}
 }
 
+// ClientBinaryEncoding 把收到的事件Data从base64解码为原始的二进制数据，与服务端的WithBinaryEncoding配合使用
+func ClientBinaryEncoding() func(c *Client) {
+	return func(c *Client) {
+		c.EncodingBase64 = true
+	}
+}
+
 type ConnCallback func(c *Client)
 
 type ResponseValidator func(c *Client, resp *http.Response) error
@@ -41,6 +50,7 @@ type Client struct {
 	ReconnectStrategy backoff.BackOff
 	disconnectcb      ConnCallback
 	connectedcb       ConnCallback
+	reconnectcb       ConnCallback
 	subscribed        map[chan *Event]chan struct{}
 	Headers           map[string]string
 	ReconnectNotify   backoff.Notify
@@ -48,7 +58,9 @@ type Client struct {
 	Connection        *http.Client
 	URL               string
 	LastEventID       atomic.Value
+	retryDelay        int64
 	maxBufferSize     int
+	lastEventIDQuery  bool
 	mu                sync.Mutex
 	EncodingBase64    bool
 	Connected         bool
@@ -75,6 +87,7 @@ func (c *Client) Subscribe(stream string, handler func(msg *Event)) error {
 }
 
 func (c *Client) SubscribeWithContext(ctx context.Context, stream string, handler func(msg *Event)) error {
+	var connected bool
 	operation := func() error {
 		resp, err := c.request(ctx, stream)
 		if err != nil {
@@ -91,6 +104,11 @@ func (c *Client) SubscribeWithContext(ctx context.Context, stream string, handle
 		}
 		defer resp.Body.Close()
 
+		if connected && c.reconnectcb != nil {
+			c.reconnectcb(c)
+		}
+		connected = true
+
 		reader := NewEventStreamReader(resp.Body, c.maxBufferSize)
 		eventChan, errorChan := c.startReadLoop(reader)
 
@@ -104,13 +122,17 @@ func (c *Client) SubscribeWithContext(ctx context.Context, stream string, handle
 		}
 	}
 
-	var err error
-	if c.ReconnectStrategy != nil {
-		err = backoff.RetryNotify(operation, c.ReconnectStrategy, c.ReconnectNotify)
-	} else {
-		err = backoff.RetryNotify(operation, backoff.NewExponentialBackOff(), c.ReconnectNotify)
-	}
-	return err
+	return c.retry(ctx, operation)
+}
+
+// SubscribeJSON 订阅JSON事件，非法的JSON数据会被丢弃
+func (c *Client) SubscribeJSON(stream string, fn func(event string, raw json.RawMessage)) error {
+	return c.Subscribe(stream, func(msg *Event) {
+		if !json.Valid(msg.Data) {
+			return
+		}
+		fn(string(msg.Event), msg.Data)
+	})
 }
 
 func (c *Client) SubscribeChan(stream string, ch chan *Event) error {
@@ -143,6 +165,8 @@ func (c *Client) SubscribeChanWithContext(ctx context.Context, stream string, ch
 		if !connected {
 			errCh <- nil
 			connected = true
+		} else if c.reconnectcb != nil {
+			c.reconnectcb(c)
 		}
 
 		reader := NewEventStreamReader(resp.Body, c.maxBufferSize)
@@ -171,12 +195,7 @@ func (c *Client) SubscribeChanWithContext(ctx context.Context, stream string, ch
 
 	go func() {
 		defer c.cleanup(ch)
-		var err error
-		if c.ReconnectStrategy != nil {
-			err = backoff.RetryNotify(operation, c.ReconnectStrategy, c.ReconnectNotify)
-		} else {
-			err = backoff.RetryNotify(operation, backoff.NewExponentialBackOff(), c.ReconnectNotify)
-		}
+		err := c.retry(ctx, operation)
 
 		if err != nil && !connected {
 			errCh <- err
@@ -187,6 +206,32 @@ func (c *Client) SubscribeChanWithContext(ctx context.Context, stream string, ch
 	return err
 }
 
+func (c *Client) retry(ctx context.Context, operation backoff.Operation) error {
+	strategy := c.ReconnectStrategy
+	if strategy == nil {
+		strategy = backoff.NewExponentialBackOff()
+	}
+	strategy = &serverRetryBackOff{BackOff: strategy, client: c}
+	return backoff.RetryNotify(operation, backoff.WithContext(strategy, ctx), c.ReconnectNotify)
+}
+
+// serverRetryBackOff 服务端通过retry字段指定了重连间隔时优先使用该间隔
+type serverRetryBackOff struct {
+	backoff.BackOff
+	client *Client
+}
+
+func (b *serverRetryBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop {
+		return next
+	}
+	if d := atomic.LoadInt64(&b.client.retryDelay); d > 0 {
+		return time.Duration(d)
+	}
+	return next
+}
+
 func (c *Client) startReadLoop(reader *EventStreamReader) (chan *Event, chan error) {
 	outCh := make(chan *Event)
 	erChan := make(chan error)
@@ -223,6 +268,10 @@ func (c *Client) readLoop(reader *EventStreamReader, outCh chan *Event, erChan c
 				msg.ID, _ = c.LastEventID.Load().([]byte)
 			}
 
+			if msg.Retry > 0 {
+				atomic.StoreInt64(&c.retryDelay, int64(msg.Retry))
+			}
+
 			if msg.hasContent() {
 				outCh <- msg
 			}
@@ -263,6 +312,11 @@ func (c *Client) OnConnect(fn ConnCallback) {
 	c.connectedcb = fn
 }
 
+// OnReconnect 断线重连成功后回调
+func (c *Client) OnReconnect(fn ConnCallback) {
+	c.reconnectcb = fn
+}
+
 func (c *Client) request(ctx context.Context, stream string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", c.URL, nil)
 	if err != nil {
@@ -270,9 +324,16 @@ func (c *Client) request(ctx context.Context, stream string) (*http.Response, er
 	}
 	req = req.WithContext(ctx)
 
-	if stream != "" {
+	lastID, exists := c.LastEventID.Load().([]byte)
+
+	if stream != "" || (c.lastEventIDQuery && exists && lastID != nil) {
 		query := req.URL.Query()
-		query.Add("stream", stream)
+		if stream != "" {
+			query.Add("stream", stream)
+		}
+		if c.lastEventIDQuery && exists && lastID != nil {
+			query.Set(QueryLastEventID, string(lastID))
+		}
 		req.URL.RawQuery = query.Encode()
 	}
 
@@ -280,7 +341,6 @@ func (c *Client) request(ctx context.Context, stream string) (*http.Response, er
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Connection", "keep-alive")
 
-	lastID, exists := c.LastEventID.Load().([]byte)
 	if exists && lastID != nil {
 		req.Header.Set("Last-Event-ID", string(lastID))
 	}
@@ -310,7 +370,9 @@ func (c *Client) processEvent(msg []byte) (event *Event, err error) {
 		case bytes.HasPrefix(line, headerEvent):
 			e.Event = append([]byte(nil), trimHeader(len(headerEvent), line)...)
 		case bytes.HasPrefix(line, headerRetry):
-			e.Retry = append([]byte(nil), trimHeader(len(headerRetry), line)...)
+			if ms, err := strconv.ParseInt(string(trimHeader(len(headerRetry), line)), 10, 64); err == nil && ms >= 0 {
+				e.Retry = time.Duration(ms) * time.Millisecond
+			}
 		default:
 		}
 	}
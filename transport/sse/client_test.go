@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
@@ -226,6 +227,32 @@ func TestClientOnConnect(t *testing.T) {
 	server.CloseClientConnections()
 }
 
+func TestClientOnReconnect(t *testing.T) {
+	setup(false)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewClient(urlPath, WithReconnectStrategy(time.Millisecond*10, time.Millisecond*100))
+
+	called := make(chan struct{}, 1)
+	c.OnReconnect(func(client *Client) {
+		called <- struct{}{}
+	})
+
+	go c.SubscribeWithContext(ctx, "test", func(msg *Event) {})
+
+	time.Sleep(time.Second)
+	server.CloseClientConnections()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second * 2):
+		assert.Fail(t, "client should reconnect within 2 seconds")
+	}
+}
+
 func TestClientChanReconnect(t *testing.T) {
 	setup(false)
 	defer cleanup()
@@ -408,3 +435,75 @@ func TestSubscribeWithContextDone(t *testing.T) {
 
 	assert.Equal(t, n1, n2)
 }
+
+func TestClientHeaders(t *testing.T) {
+	s := NewServer(
+		WithSubscribeAuthorizer(func(r *http.Request, streamID string) error {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				return errors.New("forbidden")
+			}
+			return nil
+		}),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+	s.Publish("test", &Event{Data: []byte("test")})
+
+	c := NewClient(server.URL+"/events", WithClientHeaders(http.Header{
+		"Authorization": []string{"Bearer token"},
+	}))
+
+	events := make(chan *Event)
+	require.Nil(t, c.SubscribeChan("test", events))
+
+	msg, err := wait(events, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("test"), msg)
+
+	c.Unsubscribe(events)
+}
+
+func TestClientServerRetry(t *testing.T) {
+	srv = newServer()
+	defer cleanup()
+
+	srv.Publish("test", &Event{Data: []byte("ping"), Retry: time.Millisecond * 10})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewClient(urlPath, WithReconnectStrategy(time.Second*5, time.Second*5))
+
+	called := make(chan struct{}, 1)
+	c.OnReconnect(func(client *Client) {
+		called <- struct{}{}
+	})
+
+	events := make(chan *Event, 1)
+	go c.SubscribeWithContext(ctx, "test", func(msg *Event) {
+		select {
+		case events <- msg:
+		default:
+		}
+	})
+
+	select {
+	case msg := <-events:
+		assert.Equal(t, time.Millisecond*10, msg.Retry)
+	case <-time.After(time.Second):
+		assert.Fail(t, "event should be received within 1 second")
+	}
+
+	server.CloseClientConnections()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		assert.Fail(t, "client should reconnect using the server retry interval")
+	}
+}
@@ -13,12 +13,12 @@ type Event struct {
 	ID        []byte
 	Data      []byte
 	Event     []byte
-	Retry     []byte
+	Retry     time.Duration
 	Comment   []byte
 }
 
 func (e *Event) hasContent() bool {
-	return len(e.ID) > 0 || len(e.Data) > 0 || len(e.Event) > 0 || len(e.Retry) > 0
+	return len(e.ID) > 0 || len(e.Data) > 0 || len(e.Event) > 0 || e.Retry > 0
 }
 
 func (e *Event) encodeBase64() {
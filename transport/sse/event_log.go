@@ -13,7 +13,21 @@ func (e *EventLog) Add(ev *Event) {
 	}
 
 	ev.ID = []byte(e.currentIndex())
-	ev.timestamp = time.Now()
+	if ev.timestamp.IsZero() {
+		ev.timestamp = time.Now()
+	}
+	*e = append(*e, ev)
+}
+
+// Append 保留事件原有的ID，用于WithEventIDFunc生成的ID
+func (e *EventLog) Append(ev *Event) {
+	if !ev.hasContent() {
+		return
+	}
+
+	if ev.timestamp.IsZero() {
+		ev.timestamp = time.Now()
+	}
 	*e = append(*e, ev)
 }
 
@@ -21,7 +35,20 @@ func (e *EventLog) Clear() {
 	*e = nil
 }
 
+// Trim 仅保留最近的limit条事件，最旧的事件先被淘汰
+func (e *EventLog) Trim(limit int) {
+	if limit <= 0 || len(*e) <= limit {
+		return
+	}
+	*e = append((*e)[:0], (*e)[len(*e)-limit:]...)
+}
+
 func (e *EventLog) Replay(s *Subscriber) {
+	if s.lastEventID != "" {
+		e.replayAfter(s)
+		return
+	}
+
 	for i := 0; i < len(*e); i++ {
 		id, _ := strconv.Atoi(string((*e)[i].ID))
 		if id >= s.eventId {
@@ -30,6 +57,24 @@ func (e *EventLog) Replay(s *Subscriber) {
 	}
 }
 
+// replayAfter 自定义的ID无法比较大小，重放ID为lastEventID的事件之后的所有事件，找不到时重放全部事件
+func (e *EventLog) replayAfter(s *Subscriber) {
+	start := 0
+	for i := range *e {
+		if string((*e)[i].ID) == s.lastEventID {
+			start = i + 1
+			break
+		}
+	}
+	for _, ev := range (*e)[start:] {
+		s.connection <- ev
+	}
+}
+
 func (e *EventLog) currentIndex() string {
-	return strconv.Itoa(len(*e))
+	if len(*e) == 0 {
+		return "0"
+	}
+	id, _ := strconv.Atoi(string((*e)[len(*e)-1].ID))
+	return strconv.Itoa(id + 1)
 }
@@ -20,3 +20,39 @@ func TestEventLog(t *testing.T) {
 
 	assert.Equal(t, 2, len(ev))
 }
+
+func TestEventLogTrim(t *testing.T) {
+	ev := make(EventLog, 0)
+
+	for i := 0; i < 5; i++ {
+		ev.Add(&Event{Data: []byte("test")})
+		ev.Trim(3)
+	}
+
+	assert.Equal(t, 3, len(ev))
+	assert.Equal(t, []byte("2"), ev[0].ID)
+	assert.Equal(t, []byte("4"), ev[2].ID)
+
+	sub := &Subscriber{eventId: 1, connection: make(chan *Event, 5)}
+	ev.Replay(sub)
+
+	assert.Equal(t, 3, len(sub.connection))
+}
+
+func TestEventLogReplayAfter(t *testing.T) {
+	ev := make(EventLog, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		ev.Append(&Event{ID: []byte(id), Data: []byte("test")})
+	}
+	assert.Equal(t, []byte("b"), ev[1].ID)
+
+	sub := &Subscriber{lastEventID: "b", connection: make(chan *Event, 5)}
+	ev.Replay(sub)
+	assert.Equal(t, 1, len(sub.connection))
+	assert.Equal(t, []byte("c"), (<-sub.connection).ID)
+
+	// 找不到时重放全部事件
+	sub = &Subscriber{lastEventID: "x", connection: make(chan *Event, 5)}
+	ev.Replay(sub)
+	assert.Equal(t, 3, len(sub.connection))
+}
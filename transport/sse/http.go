@@ -2,9 +2,12 @@ package sse
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,8 +16,10 @@ func (s *Server) prepareHeaderForSSE(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if s.corsOrigins == nil {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
 
 	for k, v := range s.headers {
 		w.Header().Set(k, v)
@@ -22,6 +27,14 @@ func (s *Server) prepareHeaderForSSE(w http.ResponseWriter) {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.corsOrigins != nil {
+		s.prepareHeaderForCORS(w, r)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
 	flusher, err := w.(http.Flusher)
 	if !err {
 		writeError(w, "Streaming unsupported!", http.StatusInternalServerError)
@@ -36,9 +49,22 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.subscribeAuthorizer != nil {
+		if err := s.subscribeAuthorizer(r, streamID); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if !s.acquireConnection() {
+		writeError(w, "Too many connections!", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.releaseConnection()
+
 	stream := s.streamMgr.Get(StreamID(streamID))
 	if stream == nil {
-		if !s.autoStream {
+		if !s.autoStream && !(s.patternMatching && isStreamPattern(StreamID(streamID))) {
 			writeError(w, "Stream not found!", http.StatusInternalServerError)
 			return
 		}
@@ -47,7 +73,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	eventId := 0
-	if id := r.Header.Get("Last-Event-ID"); id != "" {
+	var lastEventID string
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		// 部分代理会过滤请求头，浏览器的EventSource也无法自定义请求头，因此也支持通过查询参数传递
+		id = r.URL.Query().Get(QueryLastEventID)
+	}
+	if id != "" && s.eventIDFunc != nil {
+		lastEventID = id
+	} else if id != "" {
 		var err error
 		eventId, err = strconv.Atoi(id)
 		if err != nil {
@@ -56,7 +90,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	sub := stream.addSubscriber(eventId, r.URL)
+	sub := stream.addSubscriber(eventId, lastEventID, r.URL)
 
 	go func() {
 		<-r.Context().Done()
@@ -64,53 +98,151 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		sub.close()
 
 		if s.autoStream && !s.autoReplay && stream.getSubscriberCount() == 0 {
-			s.streamMgr.RemoveWithID(StreamID(streamID))
+			// 只删除订阅时的流，流可能已经被CloseStream删除并重新创建
+			s.streamMgr.Remove(stream)
 		}
 	}()
 
-	w.WriteHeader(http.StatusOK)
-	flusher.Flush()
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if s.compression && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Del("Content-Length")
 
-	for ev := range sub.connection {
-		if len(ev.Data) == 0 && len(ev.Comment) == 0 {
-			break
-		}
+		gz = gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
 
-		if s.eventTTL != 0 && time.Now().After(ev.timestamp.Add(s.eventTTL)) {
-			continue
+	flush := func() {
+		if gz != nil {
+			_ = gz.Flush()
 		}
+		flusher.Flush()
+	}
 
-		if len(ev.Data) > 0 {
-			_, _ = writeData(w, FieldId, ev.ID)
-
-			if s.splitData {
-				sd := bytes.Split(ev.Data, []byte("\n"))
-				for i := range sd {
-					_, _ = writeData(w, FieldData, sd[i])
-				}
-			} else {
-				if bytes.HasPrefix(ev.Data, []byte(":")) {
-					_, _ = fmt.Fprintf(w, "%s\n", ev.Data)
-				} else {
-					_, _ = writeData(w, FieldData, ev.Data)
-				}
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	var keepAlive Timer
+	var keepAliveC <-chan time.Time
+	if s.keepAlive > 0 {
+		keepAlive = s.clock.NewTimer(s.keepAlive)
+		defer keepAlive.Stop()
+		keepAliveC = keepAlive.C()
+	}
+	lastWrite := s.clock.Now()
+
+	for {
+		select {
+		case <-keepAliveC:
+			// 距离上次写入不足keepAlive时不发送，等到满keepAlive时再检查
+			if idle := s.clock.Now().Sub(lastWrite); idle < s.keepAlive {
+				keepAlive.Reset(s.keepAlive - idle)
+				continue
+			}
+			_, _ = fmt.Fprint(out, ": keepalive\n\n")
+			flush()
+			lastWrite = s.clock.Now()
+			keepAlive.Reset(s.keepAlive)
+
+		case ev, ok := <-sub.connection:
+			if !ok || (len(ev.Data) == 0 && len(ev.Comment) == 0) {
+				return
 			}
 
-			if len(ev.Event) > 0 {
-				_, _ = writeData(w, FieldEvent, ev.Event)
+			if s.eventTTL != 0 && s.clock.Now().After(ev.timestamp.Add(s.eventTTL)) {
+				continue
 			}
 
-			if len(ev.Retry) > 0 {
-				_, _ = writeData(w, FieldRetry, ev.Retry)
+			s.writeEvent(out, ev)
+			flush()
+			lastWrite = s.clock.Now()
+		}
+	}
+}
+
+func (s *Server) writeEvent(w io.Writer, ev *Event) {
+	if len(ev.Data) > 0 {
+		_, _ = writeData(w, FieldId, ev.ID)
+
+		if s.splitData {
+			sd := bytes.Split(ev.Data, []byte("\n"))
+			for i := range sd {
+				_, _ = writeData(w, FieldData, sd[i])
+			}
+		} else {
+			if bytes.HasPrefix(ev.Data, []byte(":")) {
+				_, _ = fmt.Fprintf(w, "%s\n", ev.Data)
+			} else {
+				_, _ = writeData(w, FieldData, ev.Data)
 			}
 		}
 
-		if len(ev.Comment) > 0 {
-			_, _ = writeData(w, "", ev.Comment)
+		if len(ev.Event) > 0 {
+			_, _ = writeData(w, FieldEvent, ev.Event)
 		}
 
-		_, _ = fmt.Fprint(w, "\n")
+		if ev.Retry > 0 {
+			_, _ = writeData(w, FieldRetry, []byte(strconv.FormatInt(ev.Retry.Milliseconds(), 10)))
+		}
+	}
 
-		flusher.Flush()
+	if len(ev.Comment) > 0 {
+		_, _ = writeData(w, "", ev.Comment)
+	}
+
+	_, _ = fmt.Fprint(w, "\n")
+}
+
+// prepareHeaderForCORS 请求的Origin在允许列表中时回写该Origin
+func (s *Server) prepareHeaderForCORS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !matchOrigin(s.corsOrigins, origin) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cache-Control, Last-Event-ID, Authorization")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+}
+
+// matchOrigin 判断origin是否匹配，支持*通配符，例如"*"、"https://*.example.com"
+func matchOrigin(allowed []string, origin string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			prefix, suffix := pattern[:i], pattern[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsGzip 客户端是否支持gzip压缩
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.Index(enc, ";"); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if strings.EqualFold(enc, "gzip") {
+			return true
+		}
 	}
+	return false
 }
@@ -1,10 +1,19 @@
 package sse
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,6 +55,73 @@ func TestHTTPStreamHandler(t *testing.T) {
 	assert.Equal(t, []byte(`test`), msg)
 }
 
+func TestHTTPStreamHandlerBinaryEncoding(t *testing.T) {
+	s := NewServer(
+		WithAddress(":8800"),
+		WithBinaryEncoding(),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	c := NewClient(server.URL+"/events", ClientBinaryEncoding())
+
+	events := make(chan *Event)
+	go func() {
+		_ = c.Subscribe("test", func(msg *Event) {
+			if len(msg.Data) > 0 {
+				events <- msg
+			}
+		})
+	}()
+
+	time.Sleep(time.Millisecond * 200)
+
+	payload := []byte{0x0a, 0x00, 0xff, '\n', '\r', '\n', 'd', 'a', 't', 'a', ':', 0x0a}
+	s.Publish("test", &Event{Data: append([]byte(nil), payload...)})
+
+	msg, err := wait(events, time.Millisecond*500)
+	require.Nil(t, err)
+	assert.Equal(t, payload, msg)
+}
+
+func TestHTTPStreamHandlerMaxConnections(t *testing.T) {
+	s := NewServer(
+		WithAddress(":8800"),
+		WithMaxConnections(1),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	first, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Equal(t, 1, s.ConnectionCount())
+
+	second, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	_ = second.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, second.StatusCode)
+	assert.Equal(t, uint64(1), s.RejectedConnections())
+
+	_ = first.Body.Close()
+	assert.Eventually(t, func() bool { return s.ConnectionCount() == 0 }, time.Second, time.Millisecond*10)
+
+	third, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	defer third.Body.Close()
+	assert.Equal(t, http.StatusOK, third.StatusCode)
+}
+
 func TestHTTPStreamHandlerExistingEvents(t *testing.T) {
 	s := NewServer(
 		WithAddress(":8800"),
@@ -123,9 +199,120 @@ func TestHTTPStreamHandlerEventID(t *testing.T) {
 	assert.Equal(t, []byte("test 3"), msg)
 }
 
+func TestHTTPStreamHandlerEventIDFunc(t *testing.T) {
+	var seq int32
+	s := NewServer(
+		WithAddress(":8800"),
+		WithEventIDFunc(func(streamID string) string {
+			return fmt.Sprintf("%s-%c", streamID, 'a'+atomic.AddInt32(&seq, 1)-1)
+		}),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	s.Publish("test", &Event{Data: []byte("test 1")})
+	s.Publish("test", &Event{Data: []byte("test 2")})
+	s.Publish("test", &Event{ID: []byte("custom"), Data: []byte("test 3")})
+
+	time.Sleep(time.Millisecond * 100)
+
+	c := NewClient(server.URL + "/events")
+	c.LastEventID.Store([]byte("test-a"))
+
+	events := make(chan *Event)
+	go func() {
+		_ = c.Subscribe("test", func(msg *Event) {
+			if len(msg.Data) > 0 {
+				events <- msg
+			}
+		})
+	}()
+
+	ev, err := waitEvent(events, time.Millisecond*500)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("test-b"), ev.ID)
+	assert.Equal(t, []byte("test 2"), ev.Data)
+
+	ev, err = waitEvent(events, time.Millisecond*500)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("custom"), ev.ID)
+}
+
+// fakeClock 只有调用Advance时时间才会前进
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), deadline: c.now.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.active = false
+			t.ch <- c.now
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	ch       chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.active
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	return active
+}
+
 func TestHTTPStreamHandlerEventTTL(t *testing.T) {
+	clock := newFakeClock()
 	s := NewServer(
 		WithAddress(":8800"),
+		WithClock(clock),
 	)
 	defer s.Stop(nil)
 
@@ -139,7 +326,7 @@ func TestHTTPStreamHandlerEventTTL(t *testing.T) {
 
 	s.Publish("test", &Event{Data: []byte("test 1")})
 	s.Publish("test", &Event{Data: []byte("test 2")})
-	time.Sleep(time.Second * 2)
+	clock.Advance(time.Second * 2)
 	s.Publish("test", &Event{Data: []byte("test 3")})
 
 	time.Sleep(time.Millisecond * 100)
@@ -234,3 +421,361 @@ func TestHTTPStreamHandlerAutoStream(t *testing.T) {
 
 	assert.Equal(t, (*Stream)(nil), sseServer.streamMgr.Get("test"))
 }
+
+func TestHTTPStreamHandlerCloseStream(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s.CreateStream("test")
+
+	resp, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	s.Publish("test", &Event{Data: []byte("test 1")})
+	assert.True(t, s.CloseStream("test"))
+
+	// 服务端发送关闭事件后断开连接
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	data := string(body)
+	assert.Contains(t, data, "data: test 1\n")
+	assert.Contains(t, data, "data: test\nevent: close\n")
+	assert.Less(t, strings.Index(data, "test 1"), strings.Index(data, "event: close"))
+
+	assert.Nil(t, s.streamMgr.Get("test"))
+	assert.False(t, s.CloseStream("test"))
+}
+
+func TestHTTPStreamHandlerCompression(t *testing.T) {
+	s := NewServer(
+		WithCompression(),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s.CreateStream("test")
+
+	subscribe := func(acceptEncoding string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events?stream=test", nil)
+		require.Nil(t, err)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		c := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := c.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	gzResp := subscribe("gzip")
+	defer gzResp.Body.Close()
+	assert.Equal(t, "gzip", gzResp.Header.Get("Content-Encoding"))
+
+	plainResp := subscribe("")
+	defer plainResp.Body.Close()
+	assert.Equal(t, "", plainResp.Header.Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(gzResp.Body)
+	require.Nil(t, err)
+
+	s.Publish("test", &Event{Data: []byte("test")})
+
+	readData := func(r *bufio.Reader) string {
+		for {
+			line, err := r.ReadString('\n')
+			require.Nil(t, err)
+			if len(line) > 6 && line[:6] == "data: " {
+				return line
+			}
+		}
+	}
+
+	assert.Equal(t, "data: test\n", readData(bufio.NewReader(gr)))
+	assert.Equal(t, "data: test\n", readData(bufio.NewReader(plainResp.Body)))
+}
+
+func TestHTTPStreamHandlerKeepAlive(t *testing.T) {
+	s := NewServer(
+		WithKeepAlive(time.Millisecond * 50),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s.CreateStream("test")
+
+	resp, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	select {
+	case line := <-lines:
+		assert.Equal(t, ": keepalive\n", line)
+	case <-time.After(time.Second):
+		assert.Fail(t, "keepalive should be sent within 1 second")
+	}
+}
+
+func TestHTTPStreamHandlerPublishJSON(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	s.Publish("test", &Event{Data: []byte("not json")})
+	require.Nil(t, s.PublishJSON("test", "greeting", map[string]string{"hello": "world"}))
+
+	type received struct {
+		event string
+		raw   string
+	}
+	events := make(chan received)
+
+	c := NewClient(server.URL + "/events")
+	go func() {
+		_ = c.SubscribeJSON("test", func(event string, raw json.RawMessage) {
+			events <- received{event: event, raw: string(raw)}
+		})
+	}()
+
+	select {
+	case r := <-events:
+		assert.Equal(t, "greeting", r.event)
+		assert.JSONEq(t, `{"hello":"world"}`, r.raw)
+	case <-time.After(time.Second):
+		assert.Fail(t, "json event should be received within 1 second")
+	}
+}
+
+func TestHTTPStreamHandlerSubscribeAuthorizer(t *testing.T) {
+	s := NewServer(
+		WithAutoStream(true),
+		WithSubscribeAuthorizer(func(r *http.Request, streamID string) error {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				return errors.New("forbidden")
+			}
+			return nil
+		}),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.False(t, s.streamMgr.Exist("test"))
+}
+
+func TestHTTPStreamHandlerCORS(t *testing.T) {
+	s := NewServer(
+		WithCORS([]string{"https://app.example.com", "https://*.example.org"}),
+	)
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, server.URL+"/events?stream=test", nil)
+		require.Nil(t, err)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://dashboard.example.org")
+	assert.Equal(t, "https://dashboard.example.org", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://evil.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestHTTPStreamHandlerPatternMatching(t *testing.T) {
+	s := NewServer(WithPatternMatching())
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("user.123")
+
+	c := NewClient(server.URL + "/events")
+	events := make(chan *Event)
+	require.Nil(t, c.SubscribeChan("user.*", events))
+	defer c.Unsubscribe(events)
+
+	assert.Equal(t, 1, s.SubscriberCount("user.*"))
+
+	s.Publish("order.1", &Event{Data: []byte("order")})
+	s.Publish("user.123", &Event{Data: []byte("user 123")})
+	s.Publish("user.456", &Event{Data: []byte("user 456")})
+
+	msg, err := wait(events, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("user 123"), msg)
+
+	msg, err = wait(events, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("user 456"), msg)
+}
+
+func TestHTTPStreamHandlerEventIDQuery(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	s.Publish("test", &Event{Data: []byte("test 1")})
+	s.Publish("test", &Event{Data: []byte("test 2")})
+	s.Publish("test", &Event{Data: []byte("test 3")})
+
+	time.Sleep(time.Millisecond * 100)
+
+	// 没有Last-Event-ID请求头时从查询参数读取
+	resp, err := http.Get(server.URL + "/events?stream=test&lastEventId=2")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	event, err := NewEventStreamReader(resp.Body, 1<<16).ReadEvent()
+	require.Nil(t, err)
+	assert.Contains(t, string(event), "data: test 3")
+
+	c := NewClient(server.URL+"/events", WithLastEventIDQuery())
+	c.LastEventID.Store([]byte("2"))
+
+	var rawQuery string
+	c.ResponseValidator = func(c *Client, resp *http.Response) error {
+		rawQuery = resp.Request.URL.RawQuery
+		return nil
+	}
+
+	events := make(chan *Event)
+	require.Nil(t, c.SubscribeChan("test", events))
+	defer c.Unsubscribe(events)
+
+	msg, err := wait(events, time.Millisecond*500)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("test 3"), msg)
+	assert.Contains(t, rawQuery, "lastEventId=2")
+}
+
+func TestHTTPStreamHandlerSnapshot(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	var state int32
+	s.SetSnapshotFunc("test", func() []*Event {
+		return []*Event{{Event: []byte("snapshot"), Data: []byte(fmt.Sprintf("state %d", atomic.LoadInt32(&state)))}}
+	})
+
+	s.Publish("test", &Event{Data: []byte("replayed")})
+	atomic.StoreInt32(&state, 1)
+	time.Sleep(time.Millisecond * 100)
+
+	resp, err := http.Get(server.URL + "/events?stream=test")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	reader := NewEventStreamReader(resp.Body, 1<<16)
+
+	// 快照在连接时生成，先于重放的事件发送
+	event, err := reader.ReadEvent()
+	require.Nil(t, err)
+	assert.Contains(t, string(event), "data: state 1")
+	assert.Contains(t, string(event), "event: snapshot")
+
+	event, err = reader.ReadEvent()
+	require.Nil(t, err)
+	assert.Contains(t, string(event), "data: replayed")
+
+	s.Publish("test", &Event{Data: []byte("live")})
+	event, err = reader.ReadEvent()
+	require.Nil(t, err)
+	assert.Contains(t, string(event), "data: live")
+}
+
+func TestHTTPStreamHandlerSnapshotEncodeBase64(t *testing.T) {
+	s := NewServer(WithEncodeBase64(true))
+	defer s.Stop(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.ServeHTTP)
+	server := httptest.NewServer(mux)
+
+	s.CreateStream("test")
+
+	// 缓存的快照事件每次都原样返回，不能被重复编码
+	cached := []*Event{{Event: []byte("snapshot"), Data: []byte("state")}}
+	s.SetSnapshotFunc("test", func() []*Event {
+		return cached
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL + "/events?stream=test")
+		require.Nil(t, err)
+
+		event, err := NewEventStreamReader(resp.Body, 1<<16).ReadEvent()
+		require.Nil(t, err)
+		assert.Contains(t, string(event), "data: c3RhdGU=\n")
+		_ = resp.Body.Close()
+	}
+
+	assert.Equal(t, []byte("state"), cached[0].Data)
+}
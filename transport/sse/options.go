@@ -3,13 +3,19 @@ package sse
 import (
 	"crypto/tls"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-kratos/kratos/v2/encoding"
+	"gopkg.in/cenkalti/backoff.v1"
 )
 
 const DefaultBufferSize = 1024
 
+// DefaultSubscriberBufferSize 每个订阅者默认缓存的事件数量
+const DefaultSubscriberBufferSize = 64
+
 type ServerOption func(o *Server)
 
 func WithNetwork(network string) ServerOption {
@@ -60,6 +66,21 @@ func WithEncodeBase64(enable bool) ServerOption {
 	}
 }
 
+// WithClock 替换事件TTL和keepalive使用的时间来源，默认使用系统时间
+func WithClock(clock Clock) ServerOption {
+	return func(s *Server) {
+		if clock != nil {
+			s.clock = clock
+		}
+	}
+}
+
+// WithBinaryEncoding 发送前把事件的Data编码为base64，二进制数据中的换行不会破坏SSE的帧格式，
+// 客户端需要使用ClientBinaryEncoding解码
+func WithBinaryEncoding() ServerOption {
+	return WithEncodeBase64(true)
+}
+
 func WithAutoStream(enable bool) ServerOption {
 	return func(s *Server) {
 		s.autoStream = enable
@@ -97,6 +118,81 @@ func WithEventTTL(timeout time.Duration) ServerOption {
 	}
 }
 
+// WithSubscribeAuthorizer 在加入或创建流之前校验订阅请求，返回错误时以403拒绝订阅
+func WithSubscribeAuthorizer(authorizer SubscribeAuthorizer) ServerOption {
+	return func(s *Server) {
+		s.subscribeAuthorizer = authorizer
+	}
+}
+
+// WithCORS 允许跨域访问的来源，支持*通配符，并处理OPTIONS预检请求
+func WithCORS(allowedOrigins []string) ServerOption {
+	return func(s *Server) {
+		s.corsOrigins = append([]string{}, allowedOrigins...)
+	}
+}
+
+// WithStreamHistoryLimit 每个流最多缓存n条用于重放的事件
+func WithStreamHistoryLimit(n int) ServerOption {
+	return func(s *Server) {
+		s.historyLimit = n
+	}
+}
+
+// EventIDFunc 为没有ID的事件生成ID
+type EventIDFunc func(streamID string) string
+
+// WithEventIDFunc 发布的事件没有ID时使用fn生成ID，例如UUID，代替默认的递增整数。
+// 客户端重连时从Last-Event-ID对应的事件之后开始重放
+func WithEventIDFunc(fn EventIDFunc) ServerOption {
+	return func(s *Server) {
+		s.eventIDFunc = fn
+	}
+}
+
+// WithCloseEvent 设置CloseStream发送给订阅者的最后一个事件，事件的Data不能为空
+func WithCloseEvent(event *Event) ServerOption {
+	return func(s *Server) {
+		s.closeEvent = event
+	}
+}
+
+// WithMaxConnections 同时最多保持n个订阅连接，超过时新的订阅返回503，n小于等于0时不限制
+func WithMaxConnections(n int) ServerOption {
+	return func(s *Server) {
+		s.maxConnections = n
+	}
+}
+
+// WithSubscriberBuffer 每个订阅者最多缓存size个事件，订阅者处理不过来时按policy处理，不再阻塞其它订阅者
+func WithSubscriberBuffer(size int, policy DropPolicy) ServerOption {
+	return func(s *Server) {
+		s.subscriberBuffer = size
+		s.dropPolicy = policy
+	}
+}
+
+// WithKeepAlive 空闲时定时发送keepalive注释，防止代理断开连接
+func WithKeepAlive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.keepAlive = interval
+	}
+}
+
+// WithCompression 客户端支持时启用gzip压缩
+func WithCompression() ServerOption {
+	return func(s *Server) {
+		s.compression = true
+	}
+}
+
+// WithPatternMatching 允许订阅通配的流ID，例如"user.*"会收到所有发布到"user.123"等流的事件
+func WithPatternMatching() ServerOption {
+	return func(s *Server) {
+		s.patternMatching = true
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 type ClientOption func(o *Client)
@@ -106,3 +202,30 @@ func WithEndpoint(uri string) ClientOption {
 		c.url = uri
 	}
 }
+
+// WithReconnectStrategy 断线后按指数退避重连，间隔从initial增长到max
+func WithReconnectStrategy(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = initial
+		b.MaxInterval = max
+		b.MaxElapsedTime = 0
+		c.ReconnectStrategy = b
+	}
+}
+
+// WithLastEventIDQuery 除了Last-Event-ID请求头，同时通过lastEventId查询参数传递最后收到的事件ID
+func WithLastEventIDQuery() ClientOption {
+	return func(c *Client) {
+		c.lastEventIDQuery = true
+	}
+}
+
+// WithClientHeaders 每次连接（包括重连）时附加的请求头，例如Authorization
+func WithClientHeaders(header http.Header) ClientOption {
+	return func(c *Client) {
+		for k, v := range header {
+			c.Headers[http.CanonicalHeaderKey(k)] = strings.Join(v, ", ")
+		}
+	}
+}
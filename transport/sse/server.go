@@ -3,10 +3,14 @@ package sse
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kratos/kratos/v2/encoding"
@@ -46,15 +50,37 @@ type Server struct {
 	headers    map[string]string
 	eventTTL   time.Duration
 	bufferSize int
+	keepAlive  time.Duration
+	clock      Clock
+
+	historyLimit int
+	eventIDFunc  EventIDFunc
+	closeEvent   *Event
+
+	subscriberBuffer int
+	dropPolicy       DropPolicy
+
+	maxConnections int
+	connections    int64
+	rejected       uint64
+
+	snapshotMu    sync.RWMutex
+	snapshotFuncs map[StreamID]SnapshotFunc
 
 	encodeBase64 bool
 	splitData    bool
 	autoStream   bool
 	autoReplay   bool
+	compression  bool
+
+	patternMatching bool
 
 	subscribeFunc   SubscriberFunction
 	unsubscribeFunc SubscriberFunction
 
+	subscribeAuthorizer SubscribeAuthorizer
+	corsOrigins         []string
+
 	streamMgr *StreamManager
 }
 
@@ -72,6 +98,7 @@ func NewServer(opts ...ServerOption) *Server {
 		autoStream: false,
 		autoReplay: true,
 		headers:    map[string]string{},
+		clock:      realClock{},
 
 		streamMgr: NewStreamManager(),
 	}
@@ -89,6 +116,7 @@ func (s *Server) Name() string {
 
 func (s *Server) Start(ctx context.Context) error {
 	if s.err != nil {
+		log.Errorf("[sse] server listen failed: %s", s.err.Error())
 		return s.err
 	}
 	s.BaseContext = func(net.Listener) context.Context {
@@ -110,10 +138,20 @@ func (s *Server) Start(ctx context.Context) error {
 }
 
 func (s *Server) Stop(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	s.streamMgr.Clean()
 
 	log.Info("[sse] server stopping")
-	return s.Shutdown(ctx)
+
+	err := s.Shutdown(ctx)
+	if err != nil && ctx.Err() != nil {
+		// 超过ctx的期限仍未排空的连接直接关闭
+		_ = s.Close()
+	}
+	return err
 }
 
 func (s *Server) Endpoint() (*url.URL, error) {
@@ -184,6 +222,16 @@ func (s *Server) listen() error {
 }
 
 func (s *Server) Publish(streamId StreamID, event *Event) {
+	event = s.process(event)
+
+	for _, p := range s.patternStreams(streamId) {
+		ev := *event
+		select {
+		case <-p.quit:
+		case p.event <- &ev:
+		}
+	}
+
 	stream := s.streamMgr.Get(streamId)
 	if stream == nil {
 		return
@@ -191,24 +239,51 @@ func (s *Server) Publish(streamId StreamID, event *Event) {
 
 	select {
 	case <-stream.quit:
-	case stream.event <- s.process(event):
+	case stream.event <- event:
 	}
 }
 
 func (s *Server) TryPublish(streamId StreamID, event *Event) bool {
+	event = s.process(event)
+
+	published := false
+	for _, p := range s.patternStreams(streamId) {
+		ev := *event
+		select {
+		case p.event <- &ev:
+			published = true
+		default:
+		}
+	}
+
 	stream := s.streamMgr.Get(streamId)
 	if stream == nil {
-		return false
+		return published
 	}
 
 	select {
-	case stream.event <- s.process(event):
+	case stream.event <- event:
 		return true
 	default:
 		return false
 	}
 }
 
+// patternStreams 返回与streamId匹配的通配订阅流
+func (s *Server) patternStreams(streamId StreamID) []*Stream {
+	if !s.patternMatching || isStreamPattern(streamId) {
+		return nil
+	}
+
+	var streams []*Stream
+	s.streamMgr.Range(func(stream *Stream) {
+		if isStreamPattern(stream.StreamID()) && matchStreamPattern(stream.StreamID(), streamId) {
+			streams = append(streams, stream)
+		}
+	})
+	return streams
+}
+
 func (s *Server) PublishData(streamId StreamID, data MessagePayload) error {
 	event := &Event{}
 
@@ -223,31 +298,159 @@ func (s *Server) PublishData(streamId StreamID, data MessagePayload) error {
 	return nil
 }
 
+// PublishJSON 将v编码为JSON后以eventName事件发布
+func (s *Server) PublishJSON(streamId StreamID, eventName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.Publish(streamId, &Event{Event: []byte(eventName), Data: data})
+
+	return nil
+}
+
 func (s *Server) run() {
 }
 
 func (s *Server) createStream(streamId StreamID) *Stream {
 	stream := newStream(streamId, s.bufferSize, s.autoReplay, s.autoStream, s.subscribeFunc, s.unsubscribeFunc)
+	stream.historyLimit = s.historyLimit
+	stream.eventIDFunc = s.eventIDFunc
+	stream.subscriberBuffer = s.subscriberBuffer
+	stream.dropPolicy = s.dropPolicy
+	stream.setSnapshotFunc(s.snapshotFunc(streamId))
 	stream.run()
 	return stream
 }
 
+// CreateStream 创建流并返回，流已存在时直接返回已有的流，可以并发调用
 func (s *Server) CreateStream(streamId StreamID) *Stream {
+	return s.streamMgr.GetOrAdd(streamId, func() *Stream {
+		return s.createStream(streamId)
+	})
+}
+
+// RemoveStream 删除流并断开该流的所有订阅者
+func (s *Server) RemoveStream(streamId StreamID) {
+	s.streamMgr.RemoveWithID(streamId)
+}
+
+// CloseStream 向流的所有订阅者发送关闭事件，然后断开订阅者并删除流，流不存在时返回false。
+// 关闭事件默认为event: close，data为流ID，可以通过WithCloseEvent设置
+func (s *Server) CloseStream(streamId StreamID) bool {
 	stream := s.streamMgr.Get(streamId)
-	if stream != nil {
-		return stream
+	if stream == nil {
+		return false
 	}
 
-	stream = s.createStream(streamId)
+	event := &Event{Event: []byte("close"), Data: []byte(streamId)}
+	if s.closeEvent != nil {
+		ev := *s.closeEvent
+		event = &ev
+	}
+	event = s.process(event)
 
-	s.streamMgr.Add(stream)
+	select {
+	case <-stream.quit:
+		return false
+	case stream.drain <- event:
+	}
 
-	return stream
+	s.streamMgr.Remove(stream)
+	return true
+}
+
+// SetSnapshotFunc 新的订阅者连接时先发送fn返回的快照事件，然后才是重放的事件和新发布的事件，fn为nil时取消
+func (s *Server) SetSnapshotFunc(streamId StreamID, fn SnapshotFunc) {
+	var snapshot SnapshotFunc
+	if fn != nil {
+		snapshot = func() []*Event {
+			// 处理副本，fn返回的事件可能被缓存并重复使用，不能原地编码
+			events := fn()
+			processed := make([]*Event, 0, len(events))
+			for _, event := range events {
+				if event == nil {
+					continue
+				}
+				ev := *event
+				processed = append(processed, s.process(&ev))
+			}
+			return processed
+		}
+	}
+
+	s.snapshotMu.Lock()
+	if s.snapshotFuncs == nil {
+		s.snapshotFuncs = make(map[StreamID]SnapshotFunc)
+	}
+	if snapshot != nil {
+		s.snapshotFuncs[streamId] = snapshot
+	} else {
+		delete(s.snapshotFuncs, streamId)
+	}
+	s.snapshotMu.Unlock()
+
+	if stream := s.streamMgr.Get(streamId); stream != nil {
+		stream.setSnapshotFunc(snapshot)
+	}
+}
+
+func (s *Server) snapshotFunc(streamId StreamID) SnapshotFunc {
+	s.snapshotMu.RLock()
+	defer s.snapshotMu.RUnlock()
+
+	return s.snapshotFuncs[streamId]
+}
+
+// StreamIDs 当前所有流的ID
+func (s *Server) StreamIDs() []StreamID {
+	var ids []StreamID
+	s.streamMgr.Range(func(stream *Stream) {
+		ids = append(ids, stream.StreamID())
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SubscriberCount 流当前的订阅者数量，流不存在时返回0
+func (s *Server) SubscriberCount(streamId StreamID) int {
+	stream := s.streamMgr.Get(streamId)
+	if stream == nil {
+		return 0
+	}
+	return stream.getSubscriberCount()
+}
+
+// ConnectionCount 当前的订阅连接数
+func (s *Server) ConnectionCount() int {
+	return int(atomic.LoadInt64(&s.connections))
+}
+
+// RejectedConnections 因超过WithMaxConnections的限制而拒绝的订阅数量
+func (s *Server) RejectedConnections() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+// acquireConnection 占用一个连接名额，超过限制时返回false
+func (s *Server) acquireConnection() bool {
+	n := atomic.AddInt64(&s.connections, 1)
+	if s.maxConnections > 0 && n > int64(s.maxConnections) {
+		atomic.AddInt64(&s.connections, -1)
+		atomic.AddUint64(&s.rejected, 1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) releaseConnection() {
+	atomic.AddInt64(&s.connections, -1)
 }
 
 func (s *Server) process(event *Event) *Event {
 	if s.encodeBase64 {
 		event.encodeBase64()
 	}
+	event.timestamp = s.clock.Now()
 	return event
 }
@@ -3,8 +3,11 @@ package sse
 import (
 	"context"
 	"errors"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -50,7 +53,7 @@ func TestServerExistingStreamPublish(t *testing.T) {
 	s.CreateStream("test")
 
 	stream := s.streamMgr.Get("test")
-	sub := stream.addSubscriber(0, nil)
+	sub := stream.addSubscriber(0, "", nil)
 
 	go func() {
 		s.Start(ctx)
@@ -88,3 +91,101 @@ func TestServerNonExistentStreamPublish(t *testing.T) {
 
 	<-interrupt
 }
+
+func TestServerStreamIDsAndSubscriberCount(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	s.CreateStream("b")
+	stream := s.CreateStream("a")
+
+	assert.Equal(t, []StreamID{"a", "b"}, s.StreamIDs())
+
+	stream.addSubscriber(0, "", nil)
+	stream.addSubscriber(0, "", nil)
+
+	assert.Equal(t, 2, s.SubscriberCount("a"))
+	assert.Equal(t, 0, s.SubscriberCount("b"))
+	assert.Equal(t, 0, s.SubscriberCount("none"))
+}
+
+func TestServerCreateAndRemoveStream(t *testing.T) {
+	s := NewServer()
+	defer s.Stop(nil)
+
+	streams := make(chan *Stream, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			streams <- s.CreateStream("test")
+		}()
+	}
+	wg.Wait()
+	close(streams)
+
+	stream := s.CreateStream("test")
+	for st := range streams {
+		assert.Same(t, stream, st)
+	}
+
+	sub := stream.addSubscriber(0, "", nil)
+
+	s.RemoveStream("test")
+
+	select {
+	case _, ok := <-sub.connection:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "subscriber should be disconnected when the stream is removed")
+	}
+	assert.Nil(t, s.streamMgr.Get("test"))
+
+	done := make(chan struct{})
+	go func() {
+		sub.close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "subscriber close should not block after the stream is removed")
+	}
+}
+
+func TestServerStartListenError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer lis.Close()
+
+	s := NewServer(WithAddress(lis.Addr().String()))
+	assert.NotNil(t, s.Start(context.Background()))
+}
+
+func TestServerStopContext(t *testing.T) {
+	s := NewServer(WithAddress("127.0.0.1:0"))
+
+	release := make(chan struct{})
+	defer close(release)
+	s.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	go func() {
+		_ = s.Start(context.Background())
+	}()
+
+	go func() {
+		_, _ = http.Get("http://" + s.lis.Addr().String() + "/slow")
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	assert.True(t, errors.Is(s.Stop(ctx), context.DeadlineExceeded))
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -1,6 +1,7 @@
 package sse
 
 import (
+	"net/http"
 	"net/url"
 	"sync"
 	"sync/atomic"
@@ -10,14 +11,30 @@ type StreamID string
 
 type SubscriberFunction func(streamID StreamID, sub *Subscriber)
 
+// SnapshotFunc 返回流当前状态的快照，每个新的订阅者连接时调用一次
+type SnapshotFunc func() []*Event
+
+// SubscribeAuthorizer 校验订阅请求，返回错误则拒绝订阅
+type SubscribeAuthorizer func(r *http.Request, streamID string) error
+
 type Stream struct {
 	id StreamID
 
 	event    chan *Event
+	drain    chan *Event
 	quit     chan struct{}
 	quitOnce sync.Once
 	eventLog EventLog
 
+	historyLimit int
+	eventIDFunc  EventIDFunc
+
+	subscriberBuffer int
+	dropPolicy       DropPolicy
+
+	snapshotMu   sync.RWMutex
+	snapshotFunc SnapshotFunc
+
 	autoReplay bool
 	autoStream bool
 
@@ -40,6 +57,7 @@ func newStream(id StreamID, buffSize int, replay, autoStream bool, onSubscribe,
 		register:      make(chan *Subscriber),
 		deregister:    make(chan *Subscriber),
 		event:         make(chan *Event, buffSize),
+		drain:         make(chan *Event),
 		quit:          make(chan struct{}),
 		eventLog:      make(EventLog, 0),
 		onSubscribe:   onSubscribe,
@@ -57,6 +75,10 @@ func (s *Stream) run() {
 			select {
 			case subscriber := <-stream.register:
 				stream.subscribers = append(stream.subscribers, subscriber)
+				for _, ev := range subscriber.snapshot {
+					subscriber.connection <- ev
+				}
+				subscriber.snapshot = nil
 				if stream.autoReplay {
 					stream.eventLog.Replay(subscriber)
 				}
@@ -72,12 +94,16 @@ func (s *Stream) run() {
 				}
 
 			case event := <-stream.event:
-				if stream.autoReplay {
-					stream.eventLog.Add(event)
-				}
-				for i := range stream.subscribers {
-					stream.subscribers[i].connection <- event
+				stream.dispatch(event)
+
+			case event := <-stream.drain:
+				// 先发送已经排队的事件，再发送最后的事件并断开所有订阅者
+				for len(stream.event) > 0 {
+					stream.dispatch(<-stream.event)
 				}
+				stream.broadcast(event)
+				stream.removeAllSubscribers()
+				return
 
 			case <-stream.quit:
 				stream.removeAllSubscribers()
@@ -87,6 +113,62 @@ func (s *Stream) run() {
 	}(s)
 }
 
+// dispatch 记录事件用于重放，然后发送给所有订阅者
+func (s *Stream) dispatch(event *Event) {
+	if s.eventIDFunc != nil && len(event.ID) == 0 {
+		event.ID = []byte(s.eventIDFunc(string(s.id)))
+	}
+	if s.autoReplay && s.eventIDFunc != nil {
+		s.eventLog.Append(event)
+		s.eventLog.Trim(s.historyLimit)
+	} else if s.autoReplay {
+		s.eventLog.Add(event)
+		s.eventLog.Trim(s.historyLimit)
+	}
+	s.broadcast(event)
+}
+
+// broadcast 把事件发送给所有订阅者，订阅者缓冲区满时按dropPolicy处理
+func (s *Stream) broadcast(event *Event) {
+	if s.dropPolicy == 0 {
+		for i := range s.subscribers {
+			s.subscribers[i].connection <- event
+		}
+		return
+	}
+
+	var slow []*Subscriber
+	for _, sub := range s.subscribers {
+		select {
+		case sub.connection <- event:
+			continue
+		default:
+		}
+
+		atomic.AddUint64(&sub.dropped, 1)
+
+		switch s.dropPolicy {
+		case DropOldest:
+			select {
+			case <-sub.connection:
+			default:
+			}
+			select {
+			case sub.connection <- event:
+			default:
+			}
+		case Disconnect:
+			slow = append(slow, sub)
+		}
+	}
+
+	for _, sub := range slow {
+		if i := s.getSubIndex(sub); i != -1 {
+			s.removeSubscriber(i)
+		}
+	}
+}
+
 func (s *Stream) close() {
 	s.quitOnce.Do(func() {
 		close(s.quit)
@@ -102,20 +184,36 @@ func (s *Stream) getSubIndex(sub *Subscriber) int {
 	return -1
 }
 
-func (s *Stream) addSubscriber(eventId int, url *url.URL) *Subscriber {
+func (s *Stream) addSubscriber(eventId int, lastEventID string, url *url.URL) *Subscriber {
 	atomic.AddInt32(&s.subscriberCount, 1)
 	sub := &Subscriber{
-		eventId:    eventId,
-		quit:       s.deregister,
-		connection: make(chan *Event, 64),
-		URL:        url,
+		eventId:     eventId,
+		lastEventID: lastEventID,
+		quit:        s.deregister,
+		done:        s.quit,
+		connection:  make(chan *Event, s.connectionBufferSize()),
+		URL:         url,
 	}
 
 	if s.autoStream {
 		sub.removed = make(chan struct{}, 1)
 	}
 
-	s.register <- sub
+	// 在注册之前生成快照，保证快照先于重放和之后发布的事件发送
+	if fn := s.getSnapshotFunc(); fn != nil {
+		sub.snapshot = fn()
+	}
+
+	select {
+	case s.register <- sub:
+	case <-s.quit:
+		atomic.AddInt32(&s.subscriberCount, -1)
+		close(sub.connection)
+		if sub.removed != nil {
+			close(sub.removed)
+		}
+		return sub
+	}
 
 	if s.onSubscribe != nil {
 		go s.onSubscribe(s.id, sub)
@@ -124,6 +222,27 @@ func (s *Stream) addSubscriber(eventId int, url *url.URL) *Subscriber {
 	return sub
 }
 
+func (s *Stream) setSnapshotFunc(fn SnapshotFunc) {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.snapshotFunc = fn
+}
+
+func (s *Stream) getSnapshotFunc() SnapshotFunc {
+	s.snapshotMu.RLock()
+	defer s.snapshotMu.RUnlock()
+
+	return s.snapshotFunc
+}
+
+func (s *Stream) connectionBufferSize() int {
+	if s.subscriberBuffer > 0 {
+		return s.subscriberBuffer
+	}
+	return DefaultSubscriberBufferSize
+}
+
 func (s *Stream) removeSubscriber(i int) {
 	atomic.AddInt32(&s.subscriberCount, -1)
 	close(s.subscribers[i].connection)
@@ -69,6 +69,20 @@ func (s *StreamManager) Add(stream *Stream) {
 	s.streams[stream.StreamID()] = stream
 }
 
+// GetOrAdd 流存在时直接返回，否则调用create创建并添加，整个过程在锁内完成
+func (s *StreamManager) GetOrAdd(streamId StreamID, create func() *Stream) *Stream {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if stream, ok := s.streams[streamId]; ok {
+		return stream
+	}
+
+	stream := create()
+	s.streams[streamId] = stream
+	return stream
+}
+
 func (s *StreamManager) RemoveWithID(streamId StreamID) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
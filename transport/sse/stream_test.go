@@ -14,7 +14,7 @@ func TestStreamAddSubscriber(t *testing.T) {
 	defer s.close()
 
 	s.event <- &Event{Data: []byte("test")}
-	sub := s.addSubscriber(0, nil)
+	sub := s.addSubscriber(0, "", nil)
 
 	assert.Equal(t, 1, s.getSubscriberCount())
 
@@ -31,7 +31,7 @@ func TestStreamRemoveSubscriber(t *testing.T) {
 	s.run()
 	defer s.close()
 
-	sub := s.addSubscriber(0, nil)
+	sub := s.addSubscriber(0, "", nil)
 	time.Sleep(time.Millisecond * 100)
 	s.deregister <- sub
 	time.Sleep(time.Millisecond * 100)
@@ -44,7 +44,7 @@ func TestStreamSubscriberClose(t *testing.T) {
 	s.run()
 	defer s.close()
 
-	sub := s.addSubscriber(0, nil)
+	sub := s.addSubscriber(0, "", nil)
 	sub.close()
 	time.Sleep(time.Millisecond * 100)
 
@@ -59,7 +59,7 @@ func TestStreamDisableAutoReplay(t *testing.T) {
 	s.autoReplay = false
 	s.event <- &Event{Data: []byte("test")}
 	time.Sleep(time.Millisecond * 100)
-	sub := s.addSubscriber(0, nil)
+	sub := s.addSubscriber(0, "", nil)
 
 	assert.Equal(t, 0, len(sub.connection))
 }
@@ -71,7 +71,7 @@ func TestStreamMultipleSubscribers(t *testing.T) {
 	s.run()
 
 	for i := 0; i < 10; i++ {
-		subs = append(subs, s.addSubscriber(0, nil))
+		subs = append(subs, s.addSubscriber(0, "", nil))
 	}
 
 	// Wait for all subscribers to be added
@@ -91,3 +91,53 @@ func TestStreamMultipleSubscribers(t *testing.T) {
 	assert.Equal(t, 0, s.getSubscriberCount())
 
 }
+
+func TestStreamSubscriberBuffer(t *testing.T) {
+	tests := []struct {
+		policy  DropPolicy
+		want    []string
+		removed bool
+	}{
+		{policy: DropOldest, want: []string{"2", "3"}},
+		{policy: DropNewest, want: []string{"1", "2"}},
+		{policy: Disconnect, want: []string{"1", "2"}, removed: true},
+	}
+
+	for _, tc := range tests {
+		s := newStream("test", 1024, false, false, nil, nil)
+		s.subscriberBuffer = 2
+		s.dropPolicy = tc.policy
+		s.run()
+
+		slow := s.addSubscriber(0, "", nil)
+		fast := s.addSubscriber(0, "", nil)
+
+		for _, data := range []string{"1", "2", "3"} {
+			s.event <- &Event{Data: []byte(data)}
+			msg, err := wait(fast.connection, time.Second)
+			require.Nil(t, err)
+			assert.Equal(t, []byte(data), msg)
+		}
+
+		var got []string
+		for ev := range slow.connection {
+			got = append(got, string(ev.Data))
+			if len(got) == len(tc.want) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond * 100)
+
+		assert.Equal(t, tc.want, got)
+		assert.Equal(t, uint64(1), slow.Dropped())
+		assert.Equal(t, uint64(0), fast.Dropped())
+		if tc.removed {
+			assert.Equal(t, 1, s.getSubscriberCount())
+		} else {
+			assert.Equal(t, 2, s.getSubscriberCount())
+		}
+
+		s.close()
+	}
+}
@@ -1,17 +1,46 @@
 package sse
 
-import "net/url"
+import (
+	"net/url"
+	"sync/atomic"
+)
+
+// DropPolicy 订阅者缓冲区满时的处理策略，零值表示阻塞等待
+type DropPolicy int
+
+const (
+	// DropOldest 丢弃缓冲区中最旧的事件
+	DropOldest DropPolicy = iota + 1
+	// DropNewest 丢弃新到的事件
+	DropNewest
+	// Disconnect 断开该订阅者
+	Disconnect
+)
 
 type Subscriber struct {
-	quit       chan *Subscriber
-	connection chan *Event
-	removed    chan struct{}
-	eventId    int
-	URL        *url.URL
+	quit        chan *Subscriber
+	done        <-chan struct{}
+	connection  chan *Event
+	removed     chan struct{}
+	eventId     int
+	lastEventID string
+	URL         *url.URL
+	dropped     uint64
+
+	snapshot []*Event
+}
+
+// Dropped 因缓冲区满而丢弃的事件数量
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
 }
 
 func (s *Subscriber) close() {
-	s.quit <- s
+	select {
+	case s.quit <- s:
+	case <-s.done:
+		// 流已经被删除，订阅者由流统一清理
+	}
 	if s.removed != nil {
 		<-s.removed
 	}
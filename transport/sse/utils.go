@@ -3,9 +3,15 @@ package sse
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
+	"path"
+	"strings"
 )
 
+// QueryLastEventID 请求头中没有Last-Event-ID时，从该查询参数读取
+const QueryLastEventID = "lastEventId"
+
 const (
 	FieldId      = "id"
 	FieldData    = "data"
@@ -43,10 +49,21 @@ func minPosInt(a, b int) int {
 	return a
 }
 
-func writeData(w http.ResponseWriter, field string, value []byte) (int, error) {
+func writeData(w io.Writer, field string, value []byte) (int, error) {
 	return fmt.Fprintf(w, "%s: %s\n", field, value)
 }
 
 func writeError(w http.ResponseWriter, message string, status int) {
 	http.Error(w, message, status)
 }
+
+// isStreamPattern 流ID是否包含通配符
+func isStreamPattern(streamId StreamID) bool {
+	return strings.ContainsAny(string(streamId), "*?[")
+}
+
+// matchStreamPattern 按glob规则匹配流ID，例如"user.*"匹配"user.123"
+func matchStreamPattern(pattern, streamId StreamID) bool {
+	matched, err := path.Match(string(pattern), string(streamId))
+	return err == nil && matched
+}
@@ -58,6 +58,13 @@ func WithCodec(c string) ServerOption {
 	}
 }
 
+// WithPingInterval 定期发送ping，超过两个周期没有收到pong则关闭连接
+func WithPingInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.pingInterval = d
+	}
+}
+
 func WithChannelBufferSize(size int) ServerOption {
 	return func(_ *Server) {
 		channelBufSize = size
@@ -46,7 +46,8 @@ type Server struct {
 	path        string
 	strictSlash bool
 
-	timeout time.Duration
+	timeout      time.Duration
+	pingInterval time.Duration
 
 	err   error
 	codec encoding.Codec
@@ -10,7 +10,9 @@ import (
 	"os/signal"
 	"syscall"
 	"testing"
+	"time"
 
+	ws "github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	api "github.com/tx7do/kratos-transport/_example/api/manual"
 )
@@ -100,3 +102,54 @@ func TestMessageMarshal(t *testing.T) {
 
 	fmt.Printf("[%d] [%s]\n", msg1.Type, string(msg1.Body))
 }
+
+func TestServerPingInterval(t *testing.T) {
+	srv := NewServer(
+		WithAddress("127.0.0.1:0"),
+		WithPath("/ping"),
+		WithPingInterval(time.Millisecond*50),
+	)
+	go func() {
+		_ = srv.Start(context.Background())
+	}()
+	defer srv.Stop(context.Background())
+
+	url := "ws://" + srv.lis.Addr().String() + "/ping"
+
+	// 默认的PingHandler会回复pong，连接保持
+	alive, _, err := ws.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 不回复pong的连接会被关闭
+	dead, _, err := ws.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	defer dead.Close()
+	dead.SetPingHandler(func(string) error { return nil })
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := dead.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection without pong should be closed")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 1, srv.SessionCount())
+}
@@ -1,6 +1,10 @@
 package websocket
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/google/uuid"
 	ws "github.com/gorilla/websocket"
@@ -15,6 +19,10 @@ type Session struct {
 	conn   *ws.Conn
 	send   chan []byte
 	server *Server
+
+	done      chan struct{}
+	closeOnce sync.Once
+	lastPong  int64
 }
 
 func NewSession(conn *ws.Conn, server *Server) *Session {
@@ -29,6 +37,7 @@ func NewSession(conn *ws.Conn, server *Server) *Session {
 		conn:   conn,
 		send:   make(chan []byte, channelBufSize),
 		server: server,
+		done:   make(chan struct{}),
 	}
 
 	return c
@@ -48,23 +57,63 @@ func (c *Session) SendMessage(message []byte) {
 	}
 }
 
+// LastPong 最近一次收到pong的时间，未启用ping时为零值
+func (c *Session) LastPong() time.Time {
+	if n := atomic.LoadInt64(&c.lastPong); n > 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
 func (c *Session) Close() {
-	c.server.unregister <- c
-	c.closeConnect()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.server.unregister <- c
+		c.closeConnect()
+	})
 }
 
 func (c *Session) Listen() {
+	if c.server.pingInterval > 0 {
+		c.setupPong()
+	}
+
 	go c.writePump()
 	go c.readPump()
 }
 
+// setupPong 超过两个ping周期没有收到pong时读取超时，连接随之关闭
+func (c *Session) setupPong() {
+	pongWait := c.server.pingInterval * 2
+
+	c.updateLastPong()
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.updateLastPong()
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+func (c *Session) updateLastPong() {
+	atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+}
+
+// closeConnect 可能在readPump中调用，不能置空conn，否则writePump会使用已置空的conn。
+// ws.Conn的Close可以和写操作并发调用。
 func (c *Session) closeConnect() {
 	//log.Info(c.SessionID(), " connection closed")
-	if c.conn != nil {
-		if err := c.conn.Close(); err != nil {
-			log.Errorf("[websocket] disconnect error: %s", err.Error())
-		}
-		c.conn = nil
+	if err := c.conn.Close(); err != nil {
+		log.Errorf("[websocket] disconnect error: %s", err.Error())
+	}
+}
+
+// closed 会话是否已经关闭
+func (c *Session) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -84,16 +133,37 @@ func (c *Session) sendBinaryMessage(message []byte) error {
 	return c.conn.WriteMessage(ws.BinaryMessage, message)
 }
 
+// writePump 连接的写操作只在这里进行，避免并发写
 func (c *Session) writePump() {
 	defer c.Close()
 
+	var ping <-chan time.Time
+	if c.server.pingInterval > 0 {
+		ticker := time.NewTicker(c.server.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
 	for {
 		select {
+		case <-c.done:
+			return
 		case msg := <-c.send:
+			if c.closed() {
+				return
+			}
 			if err := c.sendBinaryMessage(msg); err != nil {
 				log.Error("[websocket] write message error: ", err)
 				return
 			}
+		case <-ping:
+			if c.closed() {
+				return
+			}
+			if err := c.conn.WriteControl(ws.PingMessage, nil, time.Now().Add(c.server.timeout)); err != nil {
+				log.Error("[websocket] write ping message error: ", err)
+				return
+			}
 		}
 	}
 }
@@ -117,10 +187,7 @@ func (c *Session) readPump() {
 			_ = c.server.messageHandler(c.SessionID(), data)
 			break
 		case ws.PingMessage:
-			if err := c.sendPongMessage(""); err != nil {
-				log.Error("[websocket] write pong message error: ", err)
-				return
-			}
+			// ping由ws.Conn默认的PingHandler回复pong，这里不写连接
 			break
 		case ws.PongMessage:
 			break